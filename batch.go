@@ -0,0 +1,155 @@
+package hbot
+
+import (
+	"strings"
+	"sync"
+)
+
+// Batch is a group of messages sent by the server with IRCv3 BATCH, such
+// as a netsplit or chat history playback.
+// ref: https://ircv3.net/specs/extensions/batch
+type Batch struct {
+	// Reference tag the server gave the batch
+	ID string
+	// Type of the batch, e.g. "netsplit" or "chathistory"
+	Type string
+	// Parameters following the type
+	Params []string
+	// Tags of the message that started the batch
+	Tags Tags
+	// Batch this one is nested in, if any
+	Parent *Batch
+
+	mu       sync.Mutex
+	messages []*Message
+	done     bool
+}
+
+// Messages returns the messages of the batch received so far, in order
+func (b *Batch) Messages() []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Message(nil), b.messages...)
+}
+
+// Done reports whether the server ended the batch
+func (b *Batch) Done() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done
+}
+
+func (b *Batch) add(m *Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, m)
+}
+
+// BatchHandler receives batches once the server ended them. The messages
+// of a batch are also passed to the bot's triggers one by one as they
+// arrive, with their Batch set.
+type BatchHandler interface {
+	HandleBatch(*Bot, *Batch)
+}
+
+// BatchHandlerFunc makes a function a BatchHandler
+type BatchHandlerFunc func(*Bot, *Batch)
+
+// HandleBatch calls f(bot, b)
+func (f BatchHandlerFunc) HandleBatch(bot *Bot, b *Batch) {
+	f(bot, b)
+}
+
+// AddBatchHandler adds a handler for completed batches
+func (bot *Bot) AddBatchHandler(h BatchHandler) {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	bot.batchHandlers = append(bot.batchHandlers, h)
+}
+
+// batchTracker follows the batches the server opens and closes, and
+// attaches them to their messages
+type batchTracker struct {
+	mu sync.Mutex
+	// Open batches by reference tag
+	open map[string]*Batch
+}
+
+func newBatchTracker() *batchTracker {
+	return &batchTracker{open: make(map[string]*Batch)}
+}
+
+func (t *batchTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open = make(map[string]*Batch)
+}
+
+// get returns the open batch with the given reference tag
+func (t *batchTracker) get(id string) *Batch {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.open[id]
+}
+
+func (t *batchTracker) Handle(bot *Bot, m *Message) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id, ok := m.Tags.Get("batch"); ok {
+		m.Batch = t.open[id]
+	}
+
+	if m.Command != "BATCH" || len(m.Params) == 0 {
+		if m.Batch != nil {
+			m.Batch.add(m)
+		}
+		return false
+	}
+
+	ref := m.Param(0)
+	switch {
+	case strings.HasPrefix(ref, "+") && len(m.Params) > 1:
+		t.open[ref[1:]] = &Batch{
+			ID:     ref[1:],
+			Type:   m.Param(1),
+			Params: m.Params[2:],
+			Tags:   m.Tags,
+			Parent: m.Batch,
+		}
+	case strings.HasPrefix(ref, "-"):
+		b := t.open[ref[1:]]
+		if b == nil {
+			return false
+		}
+		delete(t.open, ref[1:])
+		b.mu.Lock()
+		b.done = true
+		b.mu.Unlock()
+		m.ended = b
+		bot.dispatchBatch(b)
+	}
+	return false
+}
+
+func (bot *Bot) dispatchBatch(b *Batch) {
+	bot.triggersMu.RLock()
+	handlers := bot.batchHandlers
+	bot.triggersMu.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+	// Keep the batch in order with its messages
+	var key string
+	if msgs := b.Messages(); len(msgs) > 0 {
+		key = bot.dispatchKey(msgs[0])
+	}
+	bot.dispatcher.submit(key, func() {
+		for _, h := range handlers {
+			func() {
+				defer bot.recoverHandler("batch")
+				h.HandleBatch(bot, b)
+			}()
+		}
+	}, bot.connContext().Done())
+}
@@ -0,0 +1,276 @@
+package hbot
+
+import (
+	"strings"
+	"sync"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Maximum length of the capability list in a single CAP REQ line
+const maxCapReqLen = 400
+
+// capNegotiator implements IRCv3 capability negotiation
+// ref: https://ircv3.net/specs/extensions/capability-negotiation
+type capNegotiator struct {
+	mu sync.Mutex
+	// Capabilities the library itself wants, on top of the bot's Caps
+	internal map[string]bool
+	// Capabilities offered by the server, with their values
+	available map[string]string
+	enabled   map[string]bool
+	// Number of CAP REQ lines that were not ACKed or NAKed yet
+	pending int
+	// Set once the (possibly multi-line) CAP LS reply is complete
+	lsDone bool
+	// Set while SASL authentication holds up CAP END
+	saslPending bool
+	// Set once CAP END was sent, or registration finished without it
+	ended bool
+}
+
+func newCapNegotiator() *capNegotiator {
+	return &capNegotiator{
+		internal:  make(map[string]bool),
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+	}
+}
+
+// want makes the library request a capability if the server supports it
+func (c *capNegotiator) want(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.internal[name] = true
+}
+
+// reset forgets the state of the previous connection
+func (c *capNegotiator) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.available = make(map[string]string)
+	c.enabled = make(map[string]bool)
+	c.pending = 0
+	c.lsDone = false
+	c.saslPending = false
+	c.ended = false
+}
+
+func (c *capNegotiator) Handle(bot *Bot, m *Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch m.Command {
+	case "CAP":
+	case irc.RPL_WELCOME:
+		// Registration is over, whether we negotiated or not
+		if !c.lsDone {
+			c.lsDone = true
+			if missing := c.missingRequired(bot); missing != "" {
+				bot.abort(&CapError{Cap: missing})
+			}
+		}
+		c.ended = true
+		return false
+	case irc.ERR_UNKNOWNCOMMAND:
+		// The server does not know about capabilities at all
+		if m.Param(1) == "CAP" {
+			c.lsDone = true
+			c.ended = true
+			if missing := c.missingRequired(bot); missing != "" {
+				bot.abort(&CapError{Cap: missing})
+				return false
+			}
+			bot.sasl.unavailable(bot)
+		}
+		return false
+	default:
+		return false
+	}
+
+	caps := strings.Fields(m.Trailing())
+	switch m.Param(1) {
+	case "LS":
+		for _, cp := range caps {
+			name, value := splitCap(cp)
+			c.available[name] = value
+		}
+		// "CAP * LS * :..." means more lines follow
+		if len(m.Params) > 3 && m.Param(2) == "*" {
+			return false
+		}
+		if c.lsDone {
+			return false
+		}
+		c.lsDone = true
+		if missing := c.missingRequired(bot); missing != "" {
+			bot.abort(&CapError{Cap: missing})
+			return false
+		}
+		if _, ok := c.available["sasl"]; !ok {
+			bot.sasl.unavailable(bot)
+		}
+		c.request(bot, c.wanted(bot))
+	case "ACK":
+		c.pending--
+		for _, cp := range caps {
+			if strings.HasPrefix(cp, "-") {
+				delete(c.enabled, cp[1:])
+				continue
+			}
+			c.enabled[cp] = true
+			if cp == "sasl" && bot.sasl.isEnabled() {
+				c.saslPending = true
+			}
+		}
+		bot.Debug("Capabilities acknowledged", "caps", caps)
+	case "NAK":
+		c.pending--
+		bot.Debug("Capabilities rejected", "caps", caps)
+		if len(caps) > 1 {
+			// A request is all or nothing, so try them one by one
+			for _, cp := range caps {
+				c.request(bot, []string{cp})
+			}
+		} else if len(caps) == 1 && isRequiredCap(bot, caps[0]) {
+			bot.abort(&CapError{Cap: caps[0], Rejected: true})
+			return false
+		} else if len(caps) == 1 && caps[0] == "sasl" {
+			bot.sasl.unavailable(bot)
+		}
+	case "NEW":
+		var want []string
+		for _, cp := range caps {
+			name, value := splitCap(cp)
+			c.available[name] = value
+			if c.wants(bot, name) && !c.enabled[name] {
+				want = append(want, name)
+			}
+		}
+		c.request(bot, want)
+	case "DEL":
+		for _, cp := range caps {
+			delete(c.available, cp)
+			delete(c.enabled, cp)
+		}
+	}
+	c.maybeEnd(bot)
+	return false
+}
+
+// wanted returns the capabilities to request out of those the server offers
+func (c *capNegotiator) wanted(bot *Bot) []string {
+	var want []string
+	for name := range c.available {
+		if c.wants(bot, name) {
+			want = append(want, name)
+		}
+	}
+	return want
+}
+
+func (c *capNegotiator) wants(bot *Bot, name string) bool {
+	if c.internal[name] || isRequiredCap(bot, name) {
+		return true
+	}
+	if name == "sasl" && bot.sasl.isEnabled() {
+		return true
+	}
+	for _, cp := range bot.Caps {
+		if cp == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *capNegotiator) missingRequired(bot *Bot) string {
+	for _, cp := range bot.RequiredCaps {
+		if _, ok := c.available[cp]; !ok {
+			return cp
+		}
+	}
+	return ""
+}
+
+func isRequiredCap(bot *Bot, name string) bool {
+	for _, cp := range bot.RequiredCaps {
+		if cp == name {
+			return true
+		}
+	}
+	return false
+}
+
+// request sends CAP REQ for the given capabilities, split over several lines
+// if needed
+func (c *capNegotiator) request(bot *Bot, caps []string) {
+	var line []string
+	var length int
+	flush := func() {
+		if len(line) == 0 {
+			return
+		}
+		c.pending++
+		bot.Send("CAP REQ :" + strings.Join(line, " "))
+		line, length = nil, 0
+	}
+	for _, cp := range caps {
+		if length+len(cp)+1 > maxCapReqLen {
+			flush()
+		}
+		line = append(line, cp)
+		length += len(cp) + 1
+	}
+	flush()
+}
+
+// maybeEnd sends CAP END once all requests were answered and SASL is done
+func (c *capNegotiator) maybeEnd(bot *Bot) {
+	if c.ended || !c.lsDone || c.pending > 0 || c.saslPending {
+		return
+	}
+	c.ended = true
+	bot.Debug("Ending capability negotiation")
+	bot.Send("CAP END")
+}
+
+// saslDone is called when SASL authentication finished, successfully or not
+func (c *capNegotiator) saslDone(bot *Bot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saslPending = false
+	c.maybeEnd(bot)
+}
+
+// splitCap splits "name=value" as found in CAP LS 302 replies
+func splitCap(cp string) (name, value string) {
+	if i := strings.IndexByte(cp, '='); i >= 0 {
+		return cp[:i], cp[i+1:]
+	}
+	return cp, ""
+}
+
+// beginCapNegotiation starts capability negotiation. The server holds off
+// registration until we send CAP END.
+func (bot *Bot) beginCapNegotiation() {
+	bot.caps.reset()
+	bot.Send("CAP LS 302")
+}
+
+// HasCap reports whether the given capability was negotiated with the server
+func (bot *Bot) HasCap(name string) bool {
+	bot.caps.mu.Lock()
+	defer bot.caps.mu.Unlock()
+	return bot.caps.enabled[name]
+}
+
+// CapValue returns the value the server advertised for a capability, such
+// as the mechanism list of "sasl". The boolean is false if the server does
+// not offer the capability.
+func (bot *Bot) CapValue(name string) (string, bool) {
+	bot.caps.mu.Lock()
+	defer bot.caps.mu.Unlock()
+	value, ok := bot.caps.available[name]
+	return value, ok
+}
@@ -0,0 +1,203 @@
+package hbot
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConn stands in for the server connection of a bot that is fed
+// messages directly
+type fakeConn struct {
+	net.Conn
+}
+
+func (fakeConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (fakeConn) SetWriteDeadline(time.Time) error { return nil }
+func (fakeConn) Close() error                     { return nil }
+
+// newTestBot returns a bot with a fake connection, whose protocol handlers
+// are fed with feed
+func newTestBot(t *testing.T, options ...func(*Bot)) *Bot {
+	t.Helper()
+	bot, err := NewBot("irc.example.org", "hbot", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.setConn(fakeConn{})
+	return bot
+}
+
+// feed passes lines from the server to the bot's protocol handlers
+func feed(bot *Bot, lines ...string) {
+	for _, line := range lines {
+		msg := ParseMessage(line)
+		for _, h := range bot.protocol {
+			h.Handle(bot, msg)
+		}
+	}
+}
+
+// sent returns the lines the bot queued since the last call
+func sent(bot *Bot) []string {
+	var lines []string
+	for {
+		select {
+		case s := <-bot.outgoing:
+			lines = append(lines, s)
+		default:
+			return lines
+		}
+	}
+}
+
+// capReqs returns the capabilities requested in lines, sorted
+func capReqs(lines []string) []string {
+	var caps []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "CAP REQ :") {
+			caps = append(caps, strings.Fields(line[len("CAP REQ :"):])...)
+		}
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func count(lines []string, line string) int {
+	n := 0
+	for _, l := range lines {
+		if l == line {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCapLSContinuation(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.Caps = []string{"multi-prefix"} })
+	feed(bot, ":irc.example.org CAP * LS * :multi-prefix away-notify")
+	if lines := sent(bot); len(lines) != 0 {
+		t.Fatalf("sent %q before the LS reply was complete", lines)
+	}
+	feed(bot, ":irc.example.org CAP * LS :server-time batch")
+	got := strings.Join(capReqs(sent(bot)), " ")
+	if want := "batch multi-prefix server-time"; got != want {
+		t.Errorf("requested %q, want %q", got, want)
+	}
+	if v, ok := bot.CapValue("away-notify"); !ok || v != "" {
+		t.Errorf("away-notify from the first LS line was not recorded")
+	}
+}
+
+func TestCapNAKSplitsRequest(t *testing.T) {
+	bot := newTestBot(t)
+	feed(bot, ":irc.example.org CAP * LS :server-time batch")
+	sent(bot)
+
+	feed(bot, ":irc.example.org CAP hbot NAK :batch server-time")
+	lines := sent(bot)
+	if count(lines, "CAP REQ :batch") != 1 || count(lines, "CAP REQ :server-time") != 1 {
+		t.Fatalf("sent %q, want each capability requested on its own", lines)
+	}
+	feed(bot, ":irc.example.org CAP hbot ACK :batch")
+	if lines := sent(bot); count(lines, "CAP END") != 0 {
+		t.Fatalf("CAP END sent with a request pending")
+	}
+	feed(bot, ":irc.example.org CAP hbot NAK :server-time")
+	if lines := sent(bot); count(lines, "CAP END") != 1 {
+		t.Fatalf("sent %q, want CAP END", lines)
+	}
+	if !bot.HasCap("batch") || bot.HasCap("server-time") {
+		t.Errorf("batch enabled = %v, server-time enabled = %v", bot.HasCap("batch"), bot.HasCap("server-time"))
+	}
+}
+
+func TestCapEndAfterSASL(t *testing.T) {
+	bot := newTestBot(t)
+	bot.sasl.SetAuth("hbot", "secret")
+	var lines []string
+	feed(bot, ":irc.example.org CAP * LS :sasl=PLAIN")
+	lines = append(lines, sent(bot)...)
+	feed(bot, ":irc.example.org CAP hbot ACK :sasl")
+	lines = append(lines, sent(bot)...)
+	if count(lines, "CAP END") != 0 {
+		t.Fatalf("CAP END sent before authenticating")
+	}
+	feed(bot, "AUTHENTICATE +")
+	feed(bot, ":irc.example.org 900 hbot hbot!hbot@host hbot :You are now logged in as hbot")
+	feed(bot, ":irc.example.org 903 hbot :SASL authentication successful")
+	feed(bot, ":irc.example.org 001 hbot :Welcome")
+	lines = append(lines, sent(bot)...)
+	if n := count(lines, "CAP END"); n != 1 {
+		t.Errorf("sent CAP END %d times, want once: %q", n, lines)
+	}
+	if bot.Account() != "hbot" {
+		t.Errorf("account = %q, want hbot", bot.Account())
+	}
+}
+
+func TestRequiredCaps(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  CapError
+	}{
+		{
+			name:  "not offered",
+			lines: []string{":irc.example.org CAP * LS :server-time"},
+			want:  CapError{Cap: "sasl"},
+		},
+		{
+			name: "rejected",
+			lines: []string{
+				":irc.example.org CAP * LS :sasl",
+				":irc.example.org CAP hbot NAK :sasl",
+			},
+			want: CapError{Cap: "sasl", Rejected: true},
+		},
+		{
+			name:  "no CAP support",
+			lines: []string{":irc.example.org 421 hbot CAP :Unknown command"},
+			want:  CapError{Cap: "sasl"},
+		},
+		{
+			name:  "registered without LS reply",
+			lines: []string{":irc.example.org 001 hbot :Welcome"},
+			want:  CapError{Cap: "sasl"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bot := newTestBot(t, func(b *Bot) { b.RequiredCaps = []string{"sasl"} })
+			feed(bot, tt.lines...)
+			var cerr *CapError
+			if err := bot.aborted(); !errors.As(err, &cerr) {
+				t.Fatalf("aborted with %v, want a *CapError", err)
+			}
+			if *cerr != tt.want {
+				t.Errorf("aborted with %+v, want %+v", *cerr, tt.want)
+			}
+		})
+	}
+}
+
+func TestEchoMessageOptIn(t *testing.T) {
+	for _, optIn := range []bool{false, true} {
+		bot := newTestBot(t, func(b *Bot) {
+			if optIn {
+				b.Caps = []string{"echo-message"}
+			}
+		})
+		feed(bot, ":irc.example.org CAP * LS :echo-message server-time")
+		requested := false
+		for _, cp := range capReqs(sent(bot)) {
+			requested = requested || cp == "echo-message"
+		}
+		if requested != optIn {
+			t.Errorf("with echo-message in Caps = %v: requested = %v", optIn, requested)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package hbot
+
+import (
+	"context"
+	"time"
+)
+
+// ContextHandler is a Handler that gets a context, which is cancelled when
+// the connection the message came in on is lost, when the bot shuts down,
+// or when the trigger's timeout (see TriggerTimeout) expires. Use it for
+// actions that make slow network calls.
+type ContextHandler interface {
+	HandleContext(ctx context.Context, bot *Bot, m *Message) bool
+}
+
+// ContextTrigger is a Trigger whose action gets a context. It can be passed
+// to AddTrigger like any Handler.
+type ContextTrigger struct {
+	// Returns true if this trigger applies to the passed in message
+	Condition func(*Bot, *Message) bool
+
+	// The action to perform if Condition is true
+	// return true if the message was 'consumed'
+	Action func(context.Context, *Bot, *Message) bool
+}
+
+// HandleContext executes the trigger action if the condition is satisfied
+func (t ContextTrigger) HandleContext(ctx context.Context, b *Bot, m *Message) bool {
+	return t.Condition(b, m) && t.Action(ctx, b, m)
+}
+
+// Handle executes the trigger action with a background context
+func (t ContextTrigger) Handle(b *Bot, m *Message) bool {
+	return t.HandleContext(context.Background(), b, m)
+}
+
+type contextAdapter struct {
+	Handler
+}
+
+func (a contextAdapter) HandleContext(ctx context.Context, b *Bot, m *Message) bool {
+	return a.Handle(b, m)
+}
+
+// WithContext returns h as a ContextHandler. Handlers that don't implement
+// ContextHandler themselves ignore the context.
+func WithContext(h Handler) ContextHandler {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch
+	}
+	return contextAdapter{h}
+}
+
+// TriggerTimeout sets how long a ContextHandler may take to handle a
+// message before its context is cancelled. Handlers are not interrupted,
+// but one that runs late is logged.
+func TriggerTimeout(timeout time.Duration) TriggerOption {
+	return func(t *trigger) {
+		t.timeout = timeout
+	}
+}
+
+// runContext returns the context passed to RunContext, or a background
+// context if the bot is not running
+func (bot *Bot) runContext() context.Context {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.runCtx == nil {
+		return context.Background()
+	}
+	return bot.runCtx
+}
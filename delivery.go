@@ -0,0 +1,141 @@
+package hbot
+
+import (
+	"context"
+	"sync"
+)
+
+// Delivery tells whether the server accepted a message sent with
+// MsgConfirm or NoticeConfirm
+type Delivery struct {
+	done   chan struct{}
+	once   sync.Once
+	echoes []*Message
+	err    error
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{})}
+}
+
+func (d *Delivery) finish(echoes []*Message, err error) {
+	d.once.Do(func() {
+		d.echoes, d.err = echoes, err
+		close(d.done)
+	})
+}
+
+// Done is closed once the server accepted or refused the message
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns why the message was not delivered, such as a *DeliveryError
+// for 404 ERR_CANNOTSENDTOCHAN. It is nil until Done is closed.
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits until the server accepted or refused the message. It returns
+// the message as echoed by the server, one per line sent, if echo-message
+// is enabled.
+func (d *Delivery) Wait(ctx context.Context) ([]*Message, error) {
+	select {
+	case <-d.done:
+		return d.echoes, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// MsgConfirm sends a message to 'who' (user or channel) like Msg, and
+// returns a Delivery telling whether the server accepted it
+func (bot *Bot) MsgConfirm(who, text string) *Delivery {
+	return bot.deliver("PRIVMSG", who, text)
+}
+
+// NoticeConfirm sends a NOTICE to 'who' (user or channel) like Notice, and
+// returns a Delivery telling whether the server accepted it
+func (bot *Bot) NoticeConfirm(who, text string) *Delivery {
+	return bot.deliver("NOTICE", who, text)
+}
+
+func (bot *Bot) deliver(command, who, text string) *Delivery {
+	d := newDelivery()
+	lines := splitText(text, bot.maxPayload(command, who), bot.SplitMarker)
+
+	// The server tells us exactly what became of each line
+	if bot.HasCap("labeled-response") {
+		go func() {
+			var echoes []*Message
+			for _, line := range lines {
+				msgs, err := bot.Request(context.Background(), command+" "+who+" :"+line)
+				if err != nil {
+					d.finish(nil, err)
+					return
+				}
+				for _, m := range msgs {
+					if isErrorReply(m) {
+						d.finish(nil, &DeliveryError{Target: who, Numeric: m.Command, Text: m.Trailing()})
+						return
+					}
+					if m.Command == command {
+						echoes = append(echoes, m)
+					}
+				}
+			}
+			d.finish(echoes, nil)
+		}()
+		return d
+	}
+
+	// Otherwise follow the lines with a PING. The server answers in order,
+	// so an error or echo arrives before the PONG if at all.
+	is := bot.ISupport()
+	token := bot.requests.newLabel()
+	var echoes []*Message
+	stop := bot.requests.watch(func(m *Message) bool {
+		switch {
+		case isErrorReply(m) && is.EqualFold(m.Param(1), who):
+			d.finish(nil, &DeliveryError{Target: who, Numeric: m.Command, Text: m.Trailing()})
+			return true
+		case m.Echo && m.Command == command && is.EqualFold(m.Param(0), who):
+			echoes = append(echoes, m)
+		case m.Command == "PONG" && m.Trailing() == token:
+			d.finish(echoes, nil)
+			return true
+		}
+		return false
+	})
+	for _, line := range lines {
+		bot.Send(command + " " + who + " :" + line)
+	}
+	bot.Send("PING " + token)
+
+	connCtx := bot.connContext()
+	go func() {
+		select {
+		case <-d.done:
+		case <-connCtx.Done():
+			stop()
+			d.finish(nil, ErrConnectionLost)
+		}
+	}()
+	return d
+}
+
+// isEcho reports whether m is the server's copy of a message the bot sent,
+// which it sends back with echo-message
+func (bot *Bot) isEcho(m *Message) bool {
+	switch m.Command {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+	default:
+		return false
+	}
+	return m.Prefix != nil && bot.HasCap("echo-message") && bot.ISupport().EqualFold(m.Prefix.Name, bot.CurrentNick())
+}
@@ -0,0 +1,173 @@
+package hbot
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DispatchMode selects how incoming messages are handed to the triggers
+type DispatchMode int
+
+const (
+	// DispatchPerTarget handles the messages of each channel, or each user
+	// for private messages, in order. Different targets are handled in
+	// parallel by DispatchWorkers goroutines.
+	DispatchPerTarget DispatchMode = iota
+	// DispatchSequential handles one message at a time, in the order they
+	// arrived
+	DispatchSequential
+	// DispatchPool handles messages on DispatchWorkers goroutines without
+	// any ordering
+	DispatchPool
+)
+
+// Defaults for the bot's DispatchWorkers and DispatchQueue
+const (
+	defaultDispatchWorkers = 8
+	defaultDispatchQueue   = 64
+)
+
+// DispatchStats tells how well the triggers keep up with incoming messages
+type DispatchStats struct {
+	// Messages waiting to be handled
+	Queued int
+	// Messages handed to the triggers so far
+	Dispatched uint64
+	// How often, and for how long in total, reading from the server was
+	// held up because the queue was full
+	Stalls    uint64
+	StallTime time.Duration
+}
+
+// dispatcher runs jobs on a fixed set of workers. Jobs submitted with the
+// same key run in order, unless all workers share a single queue.
+type dispatcher struct {
+	// Updated atomically, first for alignment
+	dispatched uint64
+	stalls     uint64
+	stallNanos int64
+
+	mu     sync.RWMutex
+	queues []chan func()
+	// Workers to run on each queue once started
+	workers int
+	started bool
+	stopped bool
+}
+
+func newDispatcher(mode DispatchMode, workers, queue int) *dispatcher {
+	if workers <= 0 {
+		workers = defaultDispatchWorkers
+	}
+	if queue <= 0 {
+		queue = defaultDispatchQueue
+	}
+	d := &dispatcher{workers: 1}
+	switch mode {
+	case DispatchSequential:
+		d.queues = []chan func(){make(chan func(), queue)}
+	case DispatchPool:
+		d.queues = []chan func(){make(chan func(), queue)}
+		d.workers = workers
+	default:
+		for i := 0; i < workers; i++ {
+			d.queues = append(d.queues, make(chan func(), queue))
+		}
+	}
+	return d
+}
+
+// start runs the workers. Jobs submitted before wait in the queues.
+func (d *dispatcher) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started || d.stopped {
+		return
+	}
+	d.started = true
+	for _, q := range d.queues {
+		for i := 0; i < d.workers; i++ {
+			go d.work(q)
+		}
+	}
+}
+
+func (d *dispatcher) work(q <-chan func()) {
+	for job := range q {
+		job()
+	}
+}
+
+// submit queues job, blocking while the queue for key is full. The job is
+// dropped if cancel is closed first.
+func (d *dispatcher) submit(key string, job func(), cancel <-chan struct{}) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		return
+	}
+	q := d.queues[0]
+	if len(d.queues) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		q = d.queues[h.Sum32()%uint32(len(d.queues))]
+	}
+	atomic.AddUint64(&d.dispatched, 1)
+	select {
+	case q <- job:
+		return
+	default:
+	}
+	start := time.Now()
+	select {
+	case q <- job:
+	case <-cancel:
+	}
+	atomic.AddUint64(&d.stalls, 1)
+	atomic.AddInt64(&d.stallNanos, int64(time.Since(start)))
+}
+
+// stop lets the workers finish what is queued and exit
+func (d *dispatcher) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	for _, q := range d.queues {
+		close(q)
+	}
+}
+
+func (d *dispatcher) stats() DispatchStats {
+	d.mu.RLock()
+	queued := 0
+	for _, q := range d.queues {
+		queued += len(q)
+	}
+	d.mu.RUnlock()
+	return DispatchStats{
+		Queued:     queued,
+		Dispatched: atomic.LoadUint64(&d.dispatched),
+		Stalls:     atomic.LoadUint64(&d.stalls),
+		StallTime:  time.Duration(atomic.LoadInt64(&d.stallNanos)),
+	}
+}
+
+// dispatchKey returns what orders m with DispatchPerTarget: the channel it
+// was sent to, otherwise its sender
+func (bot *Bot) dispatchKey(m *Message) string {
+	is := bot.ISupport()
+	if is.IsChannel(m.To) {
+		return is.Fold(m.To)
+	}
+	return is.Fold(m.From)
+}
+
+// DispatchStats returns statistics about the handling of incoming messages
+func (bot *Bot) DispatchStats() DispatchStats {
+	return bot.dispatcher.stats()
+}
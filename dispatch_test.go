@@ -0,0 +1,49 @@
+package hbot
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPingNotHeldUpByTriggers(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot", func(b *Bot) {
+		b.Dispatch = DispatchSequential
+		b.DispatchQueue = 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	bot.AddTrigger(Trigger{
+		Condition: func(*Bot, *Message) bool { return true },
+		Action: func(*Bot, *Message) bool {
+			<-release
+			return true
+		},
+	})
+	bot.dispatcher.start()
+	defer bot.dispatcher.stop()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	go bot.handleIncomingMessages(client)
+	go func() {
+		for range bot.Incoming {
+		}
+	}()
+
+	// The first message blocks the only worker, the second fills its queue
+	server.Write([]byte(":alice!a@host PRIVMSG #chan :one\r\n"))
+	server.Write([]byte(":alice!a@host PRIVMSG #chan :two\r\n"))
+	server.Write([]byte("PING :irc.example.org\r\n"))
+	select {
+	case s := <-bot.outgoing:
+		if s != "PONG :irc.example.org" {
+			t.Errorf("sent %q, want PONG", s)
+		}
+	case <-time.After(time.Second):
+		t.Error("PING was not answered while a trigger was blocked")
+	}
+}
@@ -0,0 +1,88 @@
+package hbot
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrPingTimeout is returned when the server sent nothing for longer
+	// than the bot's PingTimeout
+	ErrPingTimeout = errors.New("hbot: ping timeout")
+	// ErrServerClosed is returned when the server closed the connection
+	// without telling us why
+	ErrServerClosed = errors.New("hbot: server closed the connection")
+	// ErrHijackTLS is returned when HijackSession is combined with SSL
+	ErrHijackTLS = errors.New("hbot: can't hijack a SSL connection")
+	// ErrConnectionLost is returned by Request when the connection is lost
+	// before the reply arrived
+	ErrConnectionLost = errors.New("hbot: connection lost")
+	// ErrNotRunning is returned by Quit when RunContext was never called
+	ErrNotRunning = errors.New("hbot: bot is not running")
+)
+
+// ServerError is returned when the server ends the connection with an
+// ERROR message or a 465 ERR_YOUREBANNEDCREEP reply.
+type ServerError struct {
+	// The numeric reply, or "ERROR"
+	Numeric string
+	// The reason given by the server
+	Text string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("hbot: server error %s: %s", e.Numeric, e.Text)
+}
+
+// Banned reports whether the server refused us because of a ban (K-line)
+func (e *ServerError) Banned() bool {
+	return e.Numeric == "465"
+}
+
+// DeliveryError is returned by a Delivery when the server refused the
+// message, e.g. with 404 ERR_CANNOTSENDTOCHAN in a moderated channel.
+type DeliveryError struct {
+	// The user or channel the message was sent to
+	Target string
+	// The error numeric
+	Numeric string
+	// The reason given by the server
+	Text string
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("hbot: message to %s refused: %s %s", e.Target, e.Numeric, e.Text)
+}
+
+// CapError is returned when the server does not offer, or refuses, one of
+// the bot's RequiredCaps.
+type CapError struct {
+	Cap string
+	// True if the server offered the capability but NAKed our request
+	Rejected bool
+}
+
+func (e *CapError) Error() string {
+	if e.Rejected {
+		return fmt.Sprintf("hbot: server rejected required capability %q", e.Cap)
+	}
+	return fmt.Sprintf("hbot: server does not support required capability %q", e.Cap)
+}
+
+// SASLError is returned when SASL authentication fails and the bot's
+// SASLFailure policy is SASLAbort or SASLRetry.
+type SASLError struct {
+	// The failure numeric, e.g. 904 ERR_SASLFAIL. Empty if we could not
+	// even start authenticating.
+	Numeric string
+	// The mechanism that failed, if any
+	Mechanism string
+	Text      string
+}
+
+func (e *SASLError) Error() string {
+	if e.Numeric == "" {
+		return "hbot: SASL authentication failed: " + e.Text
+	}
+	return fmt.Sprintf("hbot: SASL authentication failed: %s %s: %s", e.Mechanism, e.Numeric, e.Text)
+}
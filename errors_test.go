@@ -0,0 +1,66 @@
+package hbot
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunContextPingTimeout(t *testing.T) {
+	bot, srv := newServedBot(t, func(b *Bot) { b.PingTimeout = 100 * time.Millisecond })
+	errc := run(bot)
+	c := srv.accept(t)
+	// The timeout starts with the first line, then the server goes quiet
+	c.send(":irc.example.org NOTICE * :Looking up your hostname")
+	if err := wait(t, errc); !errors.Is(err, ErrPingTimeout) {
+		t.Errorf("RunContext = %v, want ErrPingTimeout", err)
+	}
+}
+
+func TestRunContextServerClosed(t *testing.T) {
+	bot, srv := newServedBot(t)
+	errc := run(bot)
+	srv.accept(t).registered(t).Close()
+	if err := wait(t, errc); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("RunContext = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestRunContextServerError(t *testing.T) {
+	bot, srv := newServedBot(t)
+	errc := run(bot)
+	c := srv.accept(t).registered(t)
+	c.send("ERROR :Closing Link: hbot (Excess Flood)")
+	c.Close()
+	var serr *ServerError
+	if err := wait(t, errc); !errors.As(err, &serr) {
+		t.Fatalf("RunContext = %v, want a *ServerError", err)
+	}
+	if serr.Numeric != "ERROR" || serr.Text != "Closing Link: hbot (Excess Flood)" || serr.Banned() {
+		t.Errorf("server error = %+v", *serr)
+	}
+}
+
+func TestRunContextBanned(t *testing.T) {
+	// Banned is final, even with a reconnect policy
+	bot, srv := newServedBot(t, func(b *Bot) {
+		b.Reconnect = &ReconnectPolicy{InitialDelay: time.Millisecond}
+	})
+	errc := run(bot)
+	c := srv.accept(t).registered(t)
+	c.send(":irc.example.org 465 hbot :You are banned from this server",
+		"ERROR :Closing Link: hbot (K-Lined)")
+	c.Close()
+	var serr *ServerError
+	if err := wait(t, errc); !errors.As(err, &serr) {
+		t.Fatalf("RunContext = %v, want a *ServerError", err)
+	}
+	if !serr.Banned() || serr.Text != "You are banned from this server" {
+		t.Errorf("server error = %+v, want the ban", *serr)
+	}
+	select {
+	case <-srv.conns:
+		t.Error("reconnected after a ban")
+	default:
+	}
+}
@@ -2,6 +2,7 @@ package command
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 
@@ -24,8 +25,9 @@ type Command struct {
 	Run         Func
 }
 
-// Func represents the Go function that will be executed when a command triggers
-type Func func(m *hbot.Message, args []string)
+// Func represents the Go function that will be executed when a command triggers.
+// ctx is cancelled when the command takes too long or the bot disconnects.
+type Func func(ctx context.Context, m *hbot.Message, args []string)
 
 // List holds the command list and prefix
 type List struct {
@@ -39,7 +41,7 @@ func (cl *List) AddCommand(c Command) {
 }
 
 // Process handles incoming messages and looks for incoming messages that start with the command prefix. Commands are triggered if they exist
-func (cl *List) Process(bot *hbot.Bot, m *hbot.Message) {
+func (cl *List) Process(ctx context.Context, bot *hbot.Bot, m *hbot.Message) {
 	// Is the first character our command prefix?
 	if m.Content[:1] == cl.Prefix {
 		parts := strings.Fields(m.Content[1:])
@@ -76,14 +78,12 @@ func (cl *List) Process(bot *hbot.Bot, m *hbot.Message) {
 		bot.Logger.Debug("action", "start processing",
 			"args", parts,
 			"full text", m.Content)
-		go func(m *hbot.Message) {
-			bot.Logger.Debug("action", "executing",
-				"full text", m.Content)
-			if len(parts) > 1 {
-				cmd.Run(m, parts[1:])
-			} else {
-				cmd.Run(m, []string{})
-			}
-		}(m)
+		bot.Logger.Debug("action", "executing",
+			"full text", m.Content)
+		if len(parts) > 1 {
+			cmd.Run(ctx, m, parts[1:])
+		} else {
+			cmd.Run(ctx, m, []string{})
+		}
 	}
 }
@@ -1,18 +1,18 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
-	"time"
 
 	hbot "github.com/whyrusleeping/hellabot"
 )
 
 // Kudos sends a kudos to the target nick
-func (core Core) Kudos(m *hbot.Message, args []string) {
+func (core Core) Kudos(ctx context.Context, m *hbot.Message, args []string) {
 	if len(args) < 1 {
 		core.Bot.Reply(m, "Please tell me who to thank!")
 		return
@@ -56,16 +56,17 @@ type cveResponse struct {
 }
 
 // GetCVE gets info about a CVE
-func (core Core) GetCVE(m *hbot.Message, args []string) {
-	client := &http.Client{
-		Timeout: time.Second * 10,
-	}
+func (core Core) GetCVE(ctx context.Context, m *hbot.Message, args []string) {
+	client := &http.Client{}
 	if len(args) < 1 {
 		core.Bot.Reply(m, "Please tell me which CVE to fetch")
 		return
 	}
 	cve := args[0]
 
+	// The lookup can take a while, show that we're on it
+	defer core.Bot.StartTyping(core.Bot.ReplyTarget(m))()
+
 	cve = strings.ToUpper(cve)
 	matched, err := regexp.MatchString("CVE-\\d{4}-\\d{4,}", cve)
 	if err != nil {
@@ -77,7 +78,7 @@ func (core Core) GetCVE(m *hbot.Message, args []string) {
 		return
 	}
 	url := fmt.Sprintf("http://cve.circl.lu/api/cve/%s", cve)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		core.Bot.Reply(m, fmt.Sprintf("error creating new request: %v", err))
 		return
@@ -5,5 +5,7 @@ go 1.14
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/whyrusleeping/hellabot v0.0.0-20200821093207-637cf59145da
-	gopkg.in/sorcix/irc.v2 v2.0.0-20200812151606-3f15758ea8c7
+	gopkg.in/inconshreveable/log15.v2 v2.0.0-20200109203555-b30bc20e4fd1
 )
+
+replace github.com/whyrusleeping/hellabot => ../..
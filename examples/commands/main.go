@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"time"
 
 	hbot "github.com/whyrusleeping/hellabot"
 	"github.com/whyrusleeping/hellabot/examples/commands/command"
@@ -45,7 +47,7 @@ func main() {
 	// Setup the command environment
 	core = &command.Core{bot, &conf}
 	// Add the command trigger (this is what triggers all command handling)
-	bot.AddTrigger(CommandTrigger)
+	bot.AddTrigger(CommandTrigger, hbot.TriggerTimeout(10*time.Second))
 	// Set the default bot logger to stdout
 	bot.Logger.SetHandler(log15.StdoutHandler)
 	// Initialize the command list
@@ -73,12 +75,12 @@ func main() {
 }
 
 // CommandTrigger passes all incoming messages to the commandList parser.
-var CommandTrigger = hbot.Trigger{
+var CommandTrigger = hbot.ContextTrigger{
 	func(bot *hbot.Bot, m *hbot.Message) bool {
 		return m.Command == "PRIVMSG"
 	},
-	func(bot *hbot.Bot, m *hbot.Message) bool {
-		cmdList.Process(bot, m)
+	func(ctx context.Context, bot *hbot.Bot, m *hbot.Message) bool {
+		cmdList.Process(ctx, bot, m)
 		return false
 	},
 }
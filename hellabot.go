@@ -2,7 +2,9 @@ package hbot
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -23,7 +25,19 @@ type Bot struct {
 	Incoming chan *Message
 	con      net.Conn
 	outgoing chan string
-	handlers []Handler
+	// Held while queueing, so that a batch goes out without other lines
+	// in between
+	sendMu   sync.Mutex
+	handlers []*trigger
+	// Guards handlers, the state of each trigger, batchHandlers and
+	// tagMsgHandlers
+	triggersMu  sync.RWMutex
+	nextTrigger TriggerID
+	// Middleware around all triggers, added with Use
+	middleware []Middleware
+	// Internal handlers that keep track of the protocol state. These run in
+	// order on the reading goroutine, before any trigger sees the message.
+	protocol []Handler
 	// When did we start? Used for uptime
 	started time.Time
 	// Unix domain abstract socket address for reconnects (linux only)
@@ -31,72 +45,186 @@ type Bot struct {
 	// Unix domain socket address for other Unixes
 	unixsock string
 	unixlist net.Listener
+	// Set once our connection was passed on to another process
+	handedOff bool
+	// Closed by Quit to stop the bot, and once RunContext has returned
+	quitting chan struct{}
+	stopped  chan struct{}
+	quitOnce sync.Once
+	// QUIT reason and timeout passed to Quit, and its outcome
+	quitReason  string
+	quitTimeout time.Duration
+	quitErr     error
+	// Set by abort, ends RunContext without reconnecting
+	abortErr error
+	// Account we are logged in to
+	account string
+	// Our nick as confirmed by the server
+	nick string
+	// Our own user and host as seen by the server
+	user string
+	host string
+	mu   sync.Mutex
 	// Log15 loggger
 	log.Logger
-	didJoinChannels sync.Once
+	didJoinChannels *sync.Once
 
 	// sasl handler
-	sasl    *saslAuth
-	addSASL sync.Once
+	sasl *saslAuth
+	// IRCv3 capability negotiation
+	caps *capNegotiator
+	// Nick collision handling
+	nicks *nickTracker
+	// Features advertised by the server
+	isupport *ISupport
+	// Channels and their members
+	state *State
+	// Open IRCv3 batches
+	batches *batchTracker
+	// Handlers for completed batches
+	batchHandlers []BatchHandler
+	// Handlers for TAGMSG
+	tagMsgHandlers []TagMsgHandler
+	// Runs the handlers
+	dispatcher *dispatcher
+	// Replies to Request
+	requests *requestTracker
+	// Cancelled when the current connection is closed
+	connCtx context.Context
+	// Context passed to RunContext
+	runCtx context.Context
 
 	// Exported fields
-	Host          string
-	Password      string
-	Channels      []string
-	SSL           bool
-	SASL          bool
+	Host     string
+	Password string
+	Channels []string
+	SSL      bool
+	SASL     bool
+	// SASL mechanisms to try, in order of preference. Defaults to PLAIN
+	// with the bot's nick and password.
+	SASLMechanisms []SASLMechanism
+	// What to do if SASL authentication fails (default SASLContinue)
+	SASLFailure   SASLFailurePolicy
 	HijackSession bool
 	// An optional function that connects to an IRC server over plaintext:
 	Dial func(network, addr string) (net.Conn, error)
 	// An optional function that connects to an IRC server over a secured connection:
 	DialTLS func(network, addr string, tlsConf *tls.Config) (*tls.Conn, error)
-	// This bots nick
+	// This bots nick, as passed to NewBot. It is not updated once the bot
+	// runs, use CurrentNick for the nick the server confirmed.
 	Nick string
+	// Nicks to try, in order, if Nick is taken while registering
+	AltNicks []string
+	// Optional function returning the nick to try after the given one was
+	// refused and AltNicks are used up. Returning "" gives up. By default
+	// an underscore is appended.
+	NickGenerator func(rejected string) string
+	// Take back our preferred nick once it is free (default true)
+	RegainNick bool
+	// How often to check if the preferred nick is free on servers without
+	// MONITOR (default 1m)
+	NickPollInterval time.Duration
 	// This bots realname
 	Realname string
 	// Duration to wait between sending of messages to avoid being
 	// kicked by the server for flooding (default 200ms)
 	ThrottleDelay time.Duration
+	// Optional marker appended to a message line when the rest of the
+	// message had to be sent on the next line, e.g. "…"
+	SplitMarker string
 	// Maxmimum time between incoming data
 	PingTimeout time.Duration
+	// IRCv3 capabilities to request if the server supports them
+	Caps []string
+	// IRCv3 capabilities the bot can't do without. The connection is
+	// aborted with a *CapError if the server doesn't grant all of them.
+	RequiredCaps []string
+	// Keep track of channels, their members and topics, and of the users
+	// in them, see State
+	TrackState bool
+	// How incoming messages are handed to the triggers (default
+	// DispatchPerTarget). Set these in an option passed to NewBot.
+	Dispatch DispatchMode
+	// Number of goroutines running triggers with DispatchPerTarget and
+	// DispatchPool (default 8)
+	DispatchWorkers int
+	// Number of messages that may wait for each worker before reading from
+	// the server is held up (default 64)
+	DispatchQueue int
+	// Optional nick or channel told about triggers that panic
+	PanicNotify string
+	// A trigger that panics PanicLimit times within PanicWindow is
+	// disabled until EnableTrigger is called (default 3 times in 1m). A
+	// negative PanicLimit never disables triggers.
+	PanicLimit  int
+	PanicWindow time.Duration
+	// Optional policy for reconnecting after the connection is lost.
+	// If nil, Run returns on disconnect.
+	Reconnect *ReconnectPolicy
 
 	TLSConfig tls.Config
 }
 
 func (bot *Bot) String() string {
-	return fmt.Sprintf("Server: %s, Channels: %v, Nick: %s", bot.Host, bot.Channels, bot.Nick)
+	return fmt.Sprintf("Server: %s, Channels: %v, Nick: %s", bot.Host, bot.Channels, bot.CurrentNick())
 }
 
 // NewBot creates a new instance of Bot
 func NewBot(host, nick string, options ...func(*Bot)) (*Bot, error) {
 	// Defaults are set here
 	bot := Bot{
-		Incoming:      make(chan *Message, 16),
-		outgoing:      make(chan string, 16),
-		started:       time.Now(),
-		unixastr:      fmt.Sprintf("@%s-%s/bot", host, nick),
-		unixsock:      fmt.Sprintf("/tmp/%s-%s-bot.sock", host, nick),
-		sasl:          &saslAuth{},
-		Host:          host,
-		Nick:          nick,
-		Realname:      nick,
-		ThrottleDelay: 200 * time.Millisecond,
-		PingTimeout:   300 * time.Second,
-		HijackSession: false,
-		SSL:           false,
-		SASL:          false,
-		Channels:      []string{"#test"},
-		Password:      "",
+		Incoming:         make(chan *Message, 16),
+		outgoing:         make(chan string, 16),
+		quitting:         make(chan struct{}),
+		stopped:          make(chan struct{}),
+		started:          time.Now(),
+		unixastr:         fmt.Sprintf("@%s-%s/bot", host, nick),
+		unixsock:         fmt.Sprintf("/tmp/%s-%s-bot.sock", host, nick),
+		sasl:             &saslAuth{},
+		caps:             newCapNegotiator(),
+		isupport:         newISupport(),
+		didJoinChannels:  new(sync.Once),
+		Host:             host,
+		Nick:             nick,
+		Realname:         nick,
+		ThrottleDelay:    200 * time.Millisecond,
+		PingTimeout:      300 * time.Second,
+		RegainNick:       true,
+		NickPollInterval: time.Minute,
+		HijackSession:    false,
+		SSL:              false,
+		SASL:             false,
+		Channels:         []string{"#test"},
+		Password:         "",
 	}
 	for _, option := range options {
 		option(&bot)
 	}
 	// Discard logs by default
-	bot.Logger = log.New("id", logext.RandId(8), "host", bot.Host, "nick", log.Lazy{bot.getNick})
+	bot.Logger = log.New("id", logext.RandId(8), "host", bot.Host, "nick", log.Lazy{Fn: bot.CurrentNick})
 
 	bot.Logger.SetHandler(log.DiscardHandler())
-	bot.AddTrigger(pingPong)
-	bot.AddTrigger(joinChannels)
+	bot.nick = bot.Nick
+	bot.nicks = &nickTracker{preferred: bot.Nick}
+	bot.state = newState(&bot)
+	bot.dispatcher = newDispatcher(bot.Dispatch, bot.DispatchWorkers, bot.DispatchQueue)
+	bot.caps.want("message-tags")
+	bot.caps.want("account-tag")
+	bot.caps.want("server-time")
+	bot.caps.want("batch")
+	bot.caps.want("labeled-response")
+	bot.caps.want(multilineCap)
+	bot.batches = newBatchTracker()
+	bot.requests = newRequestTracker()
+	// Batches go first, so that every handler sees a message's batch
+	bot.protocol = []Handler{bot.batches, pingPong, parseISupport, bot.caps, bot.sasl, bot.nicks, bot.requests}
+	if bot.TrackState {
+		for _, cp := range stateCaps {
+			bot.caps.want(cp)
+		}
+		bot.protocol = append(bot.protocol, bot.state)
+	}
+	bot.AddTrigger(joinChannels, builtinTrigger)
 	return &bot, nil
 }
 
@@ -105,10 +233,6 @@ func (bot *Bot) Uptime() string {
 	return fmt.Sprintf("Started: %s, Uptime: %s", bot.started, time.Since(bot.started))
 }
 
-func (bot *Bot) getNick() string {
-	return bot.Nick
-}
-
 func (bot *Bot) connect(host string) (err error) {
 	bot.Debug("Connecting")
 	dial := bot.Dial
@@ -120,49 +244,218 @@ func (bot *Bot) connect(host string) (err error) {
 		dialTLS = tls.Dial
 	}
 
+	var con net.Conn
 	if bot.SSL {
-		bot.con, err = dialTLS("tcp", host, &bot.TLSConfig)
+		con, err = dialTLS("tcp", host, &bot.TLSConfig)
 	} else {
-		bot.con, err = dial("tcp", host)
+		con, err = dial("tcp", host)
+	}
+	if err != nil {
+		return fmt.Errorf("hbot: dial %s: %w", host, err)
+	}
+	bot.setConn(con)
+	return nil
+}
+
+func (bot *Bot) conn() net.Conn {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.con
+}
+
+func (bot *Bot) setConn(con net.Conn) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.con = con
+}
+
+// handOff is called once our connection was passed to another process.
+// It stops this bot without reconnecting.
+func (bot *Bot) handOff() {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.handedOff = true
+	bot.con.Close()
+}
+
+func (bot *Bot) isHandedOff() bool {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.handedOff
+}
+
+// abort closes the connection because of an unrecoverable error. RunContext
+// returns err instead of reconnecting.
+func (bot *Bot) abort(err error) {
+	bot.Error("Aborting connection", "err", err)
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.abortErr == nil {
+		bot.abortErr = err
+	}
+	bot.con.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprint(bot.con, "QUIT\r\n")
+	bot.con.Close()
+}
+
+func (bot *Bot) aborted() error {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.abortErr
+}
+
+// dispatch passes a message to the handlers until one consumes it
+func (bot *Bot) dispatch(msg *Message) {
+	bot.dispatchContext(bot.connContext(), msg)
+}
+
+// dispatchContext is dispatch with the context handlers get
+func (bot *Bot) dispatchContext(ctx context.Context, msg *Message) {
+	bot.dispatcher.submit(bot.dispatchKey(msg), func() {
+		bot.runTriggers(ctx, msg)
+	}, ctx.Done())
+}
+
+// runTriggers passes a message to the built-in triggers, then through the
+// bot's middleware to the others, until one consumes it
+func (bot *Bot) runTriggers(ctx context.Context, msg *Message) {
+	var user []*trigger
+	for _, t := range bot.triggers() {
+		if !t.builtin {
+			user = append(user, t)
+		} else if bot.runTrigger(ctx, t, msg) {
+			return
+		}
+	}
+	if len(user) > 0 {
+		// Triggers recover themselves, but the middleware around them doesn't
+		defer bot.recoverHandler("middleware")
+		bot.withMiddleware(contextBound{ctx: ctx, h: triggerLoop{user}}).Handle(bot, msg)
 	}
-	return err
 }
 
 // Incoming message gathering routine
-func (bot *Bot) handleIncomingMessages() {
-	scan := bufio.NewScanner(bot.con)
+// The returned error tells why the connection was lost.
+func (bot *Bot) handleIncomingMessages(con net.Conn) error {
+	// Set when the server tells us why it is closing the link
+	var serverErr *ServerError
+	scan := bufio.NewScanner(con)
 	for scan.Scan() {
 		// Disconnect if we have seen absolutely nothing for 300 seconds
-		bot.con.SetDeadline(time.Now().Add(bot.PingTimeout))
+		con.SetDeadline(time.Now().Add(bot.PingTimeout))
 		msg := ParseMessage(scan.Text())
+		if msg == nil {
+			bot.Warn("Ignoring invalid message", "raw", scan.Text())
+			continue
+		}
+		msg.Echo = bot.isEcho(msg)
 		bot.Debug("Incoming", "raw", scan.Text(), "msg.To", msg.To, "msg.From", msg.From, "msg.Params", msg.Params, "msg.Trailing", msg.Trailing())
-		go func() {
-			for _, h := range bot.handlers {
-				if h.Handle(bot, msg) {
-					break
-				}
+		switch msg.Command {
+		case "ERROR":
+			if serverErr == nil {
+				serverErr = &ServerError{Numeric: msg.Command, Text: msg.Content}
+			}
+		case irc.ERR_YOUREBANNEDCREEP:
+			serverErr = &ServerError{Numeric: msg.Command, Text: msg.Content}
+		}
+		for _, h := range bot.protocol {
+			h.Handle(bot, msg)
+		}
+		// Triggers get the lines of a multiline message in one go
+		if isMultilinePart(msg) {
+			continue
+		}
+		// PING was answered above, triggers never see it
+		if msg.Command == "PING" {
+			bot.Incoming <- msg
+			continue
+		}
+		// Answering our own messages could go on forever
+		if !msg.Echo {
+			bot.dispatch(msg)
+			if msg.Command == "TAGMSG" {
+				bot.dispatchTagMsg(msg)
 			}
-		}()
+		}
 		bot.Incoming <- msg
+		if msg.ended != nil && msg.ended.Type == multilineCap {
+			if joined := joinMultiline(msg.ended); joined != nil {
+				if !joined.Echo {
+					bot.dispatch(joined)
+				}
+				bot.Incoming <- joined
+			}
+		}
 	}
 
-	if err := scan.Err(); err != nil {
-		bot.Crit("bot.handleIncomingMessages error", "err", err.Error())
+	err := scan.Err()
+	if err != nil {
+		bot.Error("bot.handleIncomingMessages error", "err", err.Error())
 	}
-
-	close(bot.Incoming)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = ErrPingTimeout
+	}
+	if serverErr != nil {
+		err = serverErr
+	}
+	if err == nil {
+		err = ErrServerClosed
+	}
+	return err
 }
 
-// Handles message speed throtling
-func (bot *Bot) handleOutgoingMessages() {
-	for s := range bot.outgoing {
+// Handles message speed throtling. Receiving a line on stop makes it flush
+// the queue, send that line as the very last one and return.
+func (bot *Bot) handleOutgoingMessages(con net.Conn, stop <-chan string) {
+	write := func(s string) bool {
 		bot.Debug("Outgoing", "data", s)
-		_, err := fmt.Fprint(bot.con, s+"\r\n")
+		_, err := fmt.Fprint(con, s+"\r\n")
 		if err != nil {
 			bot.Error("handleOutgoingMessages fmt.Fprint error", "err", err)
-			return
+			// Make the reader notice as well
+			con.Close()
+			return false
 		}
 		time.Sleep(bot.ThrottleDelay)
+		return true
+	}
+	for {
+		select {
+		case s := <-bot.outgoing:
+			if !write(s) {
+				bot.discardOutgoing(stop)
+				return
+			}
+		case last, ok := <-stop:
+			if !ok {
+				return
+			}
+		flush:
+			for {
+				select {
+				case s := <-bot.outgoing:
+					if !write(s) {
+						return
+					}
+				default:
+					break flush
+				}
+			}
+			write(last)
+			return
+		}
+	}
+}
+
+// discardOutgoing drops queued messages until stop is signalled, so that
+// senders don't block on a dead connection
+func (bot *Bot) discardOutgoing(stop <-chan string) {
+	for {
+		select {
+		case <-bot.outgoing:
+		case <-stop:
+			return
+		}
 	}
 }
 
@@ -179,12 +472,14 @@ func (bot *Bot) WaitFor(filter func(*Message) bool) {
 // StandardRegistration performsa a basic set of registration commands
 func (bot *Bot) StandardRegistration() {
 	//Server registration
+	bot.beginCapNegotiation()
 	if bot.Password != "" {
 		bot.Send("PASS " + bot.Password)
 	}
 	bot.Debug("Sending standard registration")
-	bot.sendUserCommand(bot.Nick, bot.Realname)
-	bot.SetNick(bot.Nick)
+	nick := bot.nicks.getPreferred()
+	bot.sendUserCommand(nick, bot.Realname)
+	bot.SetNick(nick)
 }
 
 // Set username, real name, and mode
@@ -192,102 +487,205 @@ func (bot *Bot) sendUserCommand(user, realname string) {
 	bot.Send(fmt.Sprintf("USER %s 0 * :%s", user, realname))
 }
 
-// SetNick sets the bots nick on the irc server
+// SetNick sets the bots nick on the irc server. The Nick field is updated
+// once the server confirms the change.
 func (bot *Bot) SetNick(nick string) {
-	bot.Nick = nick
+	bot.nicks.setPreferred(nick)
 	bot.Send(fmt.Sprintf("NICK %s", nick))
 }
 
 // Run starts the bot and connects to the server. Blocks until we disconnect from the server.
 func (bot *Bot) Run() {
+	if err := bot.RunContext(context.Background()); err != nil {
+		bot.Crit("bot.Run error", "err", err.Error())
+	}
+}
+
+// RunContext starts the bot and connects to the server. It blocks until we
+// disconnect from the server or ctx is cancelled, in which case a QUIT is
+// sent before closing the connection. The returned error tells why the bot
+// stopped, e.g. ErrPingTimeout, ErrServerClosed, a *ServerError or the error
+// from dialing the server. It is ctx.Err() after a cancellation and nil if
+// the connection was handed to another process or Quit was called.
+func (bot *Bot) RunContext(ctx context.Context) error {
 	bot.Debug("Starting bot goroutines")
+	if bot.HijackSession && bot.SSL {
+		return ErrHijackTLS
+	}
+	bot.mu.Lock()
+	bot.runCtx = ctx
+	bot.mu.Unlock()
 
 	// Attempt reconnection
 	var hijack bool
 	if bot.HijackSession {
-		if bot.SSL {
-			bot.Crit("Can't Hijack a SSL connection")
-			return
-		}
 		hijack = bot.hijackSession()
 		bot.Debug("Hijack", "Did we?", hijack)
 	}
 
+	// Workers only run while the bot does
+	bot.dispatcher.start()
+	defer func() {
+		bot.mu.Lock()
+		close(bot.stopped)
+		bot.mu.Unlock()
+		bot.Close()
+		close(bot.Incoming)
+		bot.dispatcher.stop()
+	}()
+
+	// Consecutive failed reconnect attempts
+	var attempts int
 	if !hijack {
 		err := bot.connect(bot.Host)
 		if err != nil {
-			bot.Crit("bot.Connect error", "err", err.Error())
-			return
+			bot.Error("bot.Connect error", "err", err.Error())
+			if err := bot.redial(ctx, &attempts, err); err != nil || bot.isQuitting() {
+				return err
+			}
+		} else {
+			bot.Info("Connected successfully!")
 		}
-		bot.Info("Connected successfully!")
 	}
 
-	go bot.handleIncomingMessages()
-	go bot.handleOutgoingMessages()
-
 	go bot.StartUnixListener()
 
-	// Only register on an initial connection
+	for {
+		connected := time.Now()
+		err := bot.serve(ctx)
+		if bot.isHandedOff() {
+			return nil
+		}
+		if err := bot.aborted(); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if bot.isQuitting() {
+			return nil
+		}
+		bot.Info("Disconnected", "err", err)
+		bot.dispatchEvent(EventDisconnected, err.Error())
+
+		var serr *ServerError
+		if errors.As(err, &serr) && serr.Banned() {
+			return err
+		}
+		if bot.Reconnect == nil {
+			return err
+		}
+		if time.Since(connected) >= bot.Reconnect.resetAfter() {
+			attempts = 0
+		}
+		if err := bot.redial(ctx, &attempts, err); err != nil || bot.isQuitting() {
+			return err
+		}
+	}
+}
+
+// serve runs the current connection until it is lost, ctx is cancelled or
+// Quit is called
+func (bot *Bot) serve(ctx context.Context) error {
+	con := bot.conn()
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	bot.mu.Lock()
+	bot.connCtx = connCtx
+	bot.isupport = newISupport()
+	bot.mu.Unlock()
+	bot.nicks.reset(bot.reconnecting)
+	bot.batches.reset()
+	bot.requests.reset()
+	stop := make(chan string)
+	wdone := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- bot.handleIncomingMessages(con)
+	}()
+	go func() {
+		bot.handleOutgoingMessages(con, stop)
+		close(wdone)
+	}()
+
+	// Only register if we did not hijack a registered session
 	if !bot.reconnecting {
+		bot.mu.Lock()
+		bot.didJoinChannels = new(sync.Once)
+		bot.account = ""
+		bot.user, bot.host = "", ""
+		bot.mu.Unlock()
+		bot.state.reset()
 		if bot.SASL {
-			bot.SASLAuthenticate(bot.Nick, bot.Password)
+			bot.SASLAuthenticate(bot.nicks.getPreferred(), bot.Password)
 		} else {
 			bot.StandardRegistration()
 		}
 	}
-	for m := range bot.Incoming {
-		if m == nil {
-			log.Info("Disconnected")
-			return
+	bot.reconnecting = false
+
+	// Nobody might be reading Incoming, so keep draining it
+	for {
+		select {
+		case <-bot.Incoming:
+		case err := <-errc:
+			close(stop)
+			<-wdone
+			con.Close()
+			return err
+		case <-ctx.Done():
+			bot.shutdown(con, stop, wdone, errc, "", 5*time.Second)
+			return ctx.Err()
+		case <-bot.quitting:
+			// Stop waiting for triggers that are held up, e.g. by the one
+			// that called Quit
+			cancel()
+			bot.mu.Lock()
+			reason, timeout := bot.quitReason, bot.quitTimeout
+			bot.mu.Unlock()
+			err := bot.shutdown(con, stop, wdone, errc, reason, timeout)
+			bot.mu.Lock()
+			bot.quitErr = err
+			bot.mu.Unlock()
+			return err
 		}
 	}
 }
 
 // Reply sends a message to where the message came from (user or channel)
 func (bot *Bot) Reply(m *Message, text string) {
-	var target string
-	if strings.Contains(m.To, "#") {
-		target = m.To
-	} else {
-		target = m.From
-	}
-	bot.Msg(target, text)
+	bot.Msg(bot.ReplyTarget(m), text)
 }
 
-// Msg sends a message to 'who' (user or channel)
+// Msg sends a message to 'who' (user or channel). Text too long for one
+// line is split, and sent as a single draft/multiline batch if the server
+// supports it.
 func (bot *Bot) Msg(who, text string) {
-	for _, line := range splitText(text) {
+	if bot.sendMultiline("PRIVMSG", who, text) {
+		return
+	}
+	for _, line := range splitText(text, bot.maxPayload("PRIVMSG", who), bot.SplitMarker) {
 		bot.Send("PRIVMSG " + who + " :" + line)
 	}
 }
 
 // Notice sends a NOTICE message to 'who' (user or channel)
 func (bot *Bot) Notice(who, text string) {
-	for _, line := range splitText(text) {
-		bot.Send("NOTICE " + who + " :" + line)
+	if bot.sendMultiline("NOTICE", who, text) {
+		return
 	}
-}
-
-// Splits a given string into a string slice, in chunks ending
-// either with \n, or with \r\n, or of a size of 400 characters.
-func splitText(text string) []string {
-	var ret []string
-	scanner := bufio.NewScanner(strings.NewReader(text))
-	for scanner.Scan() {
-		line := scanner.Text()
-		for len(line) > 400 {
-			ret = append(ret, line[:400])
-			line = line[400:]
-		}
-		ret = append(ret, line)
+	for _, line := range splitText(text, bot.maxPayload("NOTICE", who), bot.SplitMarker) {
+		bot.Send("NOTICE " + who + " :" + line)
 	}
-	return ret
 }
 
 // Action sends an action to 'who' (user or channel)
 func (bot *Bot) Action(who, text string) {
-	msg := fmt.Sprintf("\u0001ACTION %s\u0001", text)
-	bot.Msg(who, msg)
+	// Split the text itself so that every line is a complete CTCP ACTION
+	size := bot.maxPayload("PRIVMSG", who) - len("\u0001ACTION \u0001")
+	for _, line := range splitText(text, size, bot.SplitMarker) {
+		bot.Send(fmt.Sprintf("PRIVMSG %s :\u0001ACTION %s\u0001", who, line))
+	}
 }
 
 // Topic sets the channel 'c' topic (requires bot has proper permissions)
@@ -297,15 +695,63 @@ func (bot *Bot) Topic(c, topic string) {
 }
 
 // Send any command to the server
+// Commands sent after Quit was called are dropped.
 func (bot *Bot) Send(command string) {
-	bot.outgoing <- command
+	bot.sendMu.Lock()
+	defer bot.sendMu.Unlock()
+	bot.queue(command)
+}
+
+// sendAll queues commands one after another, with nothing else sent in
+// between
+func (bot *Bot) sendAll(commands []string) {
+	bot.sendMu.Lock()
+	defer bot.sendMu.Unlock()
+	for _, command := range commands {
+		bot.queue(command)
+	}
+}
+
+// queue hands a command to the writer. The caller holds sendMu.
+func (bot *Bot) queue(command string) {
+	if bot.isQuitting() {
+		bot.Warn("Dropping message, bot is quitting", "data", command)
+		return
+	}
+	select {
+	case bot.outgoing <- command:
+	case <-bot.quitting:
+		bot.Warn("Dropping message, bot is quitting", "data", command)
+	}
 }
 
 // ChMode is used to change users modes in a channel
 // operator = "+o" deop = "-o"
 // ban = "+b"
 func (bot *Bot) ChMode(user, channel, mode string) {
-	bot.Send("MODE " + channel + " " + mode + " " + user)
+	bot.ChModes(channel, mode, user)
+}
+
+// ChModes changes the mode of several users in a channel, e.g. to op them
+// all with mode "+o". It sends as many modes per MODE command as the server
+// allows.
+func (bot *Bot) ChModes(channel, mode string, users ...string) {
+	if len(mode) < 2 {
+		return
+	}
+	sign, letters := mode[:1], mode[1:]
+	per := bot.ISupport().Modes()
+	if per < 1 {
+		per = 1
+	}
+	for len(users) > 0 {
+		n := per
+		if n > len(users) {
+			n = len(users)
+		}
+		bot.Send("MODE " + channel + " " + sign + strings.Repeat(letters, n) + " " + strings.Join(users[:n], " "))
+		users = users[n:]
+	}
 }
 
 // Join a channel
@@ -318,17 +764,28 @@ func (bot *Bot) Part(ch, msg string) {
 	bot.Send("PART " + ch + " " + msg)
 }
 
-// Close closes the bot
+// Close closes the bot's unix listener. Use Quit to disconnect from the server.
 func (bot *Bot) Close() error {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
 	if bot.unixlist != nil {
 		return bot.unixlist.Close()
 	}
 	return nil
 }
 
-// AddTrigger adds a trigger to the bot's handlers
-func (bot *Bot) AddTrigger(h Handler) {
-	bot.handlers = append(bot.handlers, h)
+// setListener records the unix listener. It returns false if the bot has
+// already stopped, in which case the listener should not be used.
+func (bot *Bot) setListener(list net.Listener) bool {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	select {
+	case <-bot.stopped:
+		return false
+	default:
+	}
+	bot.unixlist = list
+	return true
 }
 
 // Handler is used to subscribe and react to events on the bot Server
@@ -354,7 +811,8 @@ func (t Trigger) Handle(b *Bot, m *Message) bool {
 // A trigger to respond to the servers ping pong messages
 // If PingPong messages are not responded to, the server assumes the
 // client has timed out and will close the connection.
-// Note: this is automatically added in the IrcCon constructor
+// Note: this runs on the reading goroutine, so that slow triggers can't
+// hold up the answer
 var pingPong = Trigger{
 	Condition: func(bot *Bot, m *Message) bool {
 		return m.Command == "PING"
@@ -370,7 +828,10 @@ var joinChannels = Trigger{
 		return m.Command == irc.RPL_WELCOME || m.Command == irc.RPL_ENDOFMOTD // 001 or 372
 	},
 	Action: func(bot *Bot, m *Message) bool {
-		bot.didJoinChannels.Do(func() {
+		bot.mu.Lock()
+		once := bot.didJoinChannels
+		bot.mu.Unlock()
+		once.Do(func() {
 			for _, channel := range bot.Channels {
 				splitchan := strings.SplitN(channel, ":", 2)
 				fmt.Println("splitchan is:", splitchan)
@@ -410,9 +871,26 @@ type Message struct {
 	// Raw contains the _raw message_
 	Raw string
 
-	//Time at which this message was recieved
+	// IRCv3 message tags, nil if the message has none
+	Tags Tags
+
+	// Batch the message is part of, nil if none
+	Batch *Batch
+	// Batch ended by this BATCH message
+	ended *Batch
+
+	// Time at which this message was sent, as told by the server with
+	// server-time, otherwise the same as ReceivedAt
 	TimeStamp time.Time
 
+	// Time at which this message was recieved
+	ReceivedAt time.Time
+
+	// Set if this is the server's copy of a message the bot sent, with
+	// echo-message, which is only requested if it is in the bot's Caps.
+	// Triggers don't see these.
+	Echo bool
+
 	// Entity that this message was addressed to (channel or user)
 	To string
 
@@ -434,7 +912,19 @@ func (m *Message) Param(i int) string {
 // TODO: Maybe just use sorbix/irc if we can be without the custom stuff?
 func ParseMessage(raw string) (m *Message) {
 	m = new(Message)
-	m.Message = irc.ParseMessage(raw)
+	line := raw
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line)
+		}
+		m.Tags = parseTags(line[1:i])
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	m.Message = irc.ParseMessage(line)
+	if m.Message == nil {
+		return nil
+	}
 	m.Content = m.Trailing()
 
 	if len(m.Params) > 0 {
@@ -445,7 +935,11 @@ func ParseMessage(raw string) (m *Message) {
 	if m.Prefix != nil {
 		m.From = m.Prefix.Name
 	}
-	m.TimeStamp = time.Now()
+	m.ReceivedAt = time.Now()
+	m.TimeStamp = m.ReceivedAt
+	if t, ok := m.ServerTime(); ok {
+		m.TimeStamp = t
+	}
 
 	m.Raw = raw
 
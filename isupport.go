@@ -0,0 +1,260 @@
+package hbot
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// ISupport holds the features the server advertised in 005 RPL_ISUPPORT.
+// Accessors return the RFC defaults for features the server did not
+// mention.
+// ref: https://modern.ircdocs.horse/#rplisupport-parameters
+type ISupport struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func newISupport() *ISupport {
+	return &ISupport{tokens: make(map[string]string)}
+}
+
+// parse reads the tokens of a 005 reply
+func (is *ISupport) parse(m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	// The first param is our nick, the last one "are supported by this server"
+	for _, token := range m.Params[1 : len(m.Params)-1] {
+		if strings.HasPrefix(token, "-") {
+			delete(is.tokens, strings.ToUpper(token[1:]))
+			continue
+		}
+		name, value := token, ""
+		if i := strings.IndexByte(token, '='); i >= 0 {
+			name, value = token[:i], unescapeISupport(token[i+1:])
+		}
+		is.tokens[strings.ToUpper(name)] = value
+	}
+}
+
+// unescapeISupport replaces \xHH escapes in token values
+func unescapeISupport(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if c, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Get returns the raw value of a token and whether the server sent it
+func (is *ISupport) Get(name string) (string, bool) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	value, ok := is.tokens[strings.ToUpper(name)]
+	return value, ok
+}
+
+func (is *ISupport) getInt(name string, def int) int {
+	value, ok := is.Get(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// ChanTypes returns the channel prefix characters (default "#&")
+func (is *ISupport) ChanTypes() string {
+	if value, ok := is.Get("CHANTYPES"); ok {
+		return value
+	}
+	return "#&"
+}
+
+// IsChannel reports whether target is a channel name
+func (is *ISupport) IsChannel(target string) bool {
+	return target != "" && strings.IndexByte(is.ChanTypes(), target[0]) >= 0
+}
+
+// Prefix returns the channel membership modes and their matching nick
+// prefixes, highest first (default "ov" and "@+")
+func (is *ISupport) Prefix() (modes, prefixes string) {
+	value, ok := is.Get("PREFIX")
+	if !ok {
+		return "ov", "@+"
+	}
+	i := strings.IndexByte(value, ')')
+	if !strings.HasPrefix(value, "(") || i < 0 || len(value[1:i]) != len(value[i+1:]) {
+		return "", ""
+	}
+	return value[1:i], value[i+1:]
+}
+
+// ChanModes returns the four groups of channel modes: list modes, modes that
+// always take a parameter, modes that take one only when set and modes that
+// never take one.
+func (is *ISupport) ChanModes() (lists, always, onSet, never string) {
+	value, ok := is.Get("CHANMODES")
+	if !ok {
+		value = "beI,k,l,imnpst"
+	}
+	groups := strings.SplitN(value, ",", 4)
+	for len(groups) < 4 {
+		groups = append(groups, "")
+	}
+	return groups[0], groups[1], groups[2], groups[3]
+}
+
+// CaseMapping returns the casemapping used for nicks and channels
+// (default "rfc1459")
+func (is *ISupport) CaseMapping() string {
+	if value, ok := is.Get("CASEMAPPING"); ok && value != "" {
+		return value
+	}
+	return "rfc1459"
+}
+
+// Fold returns name in the server's canonical case, for use as map key or
+// for comparisons
+func (is *ISupport) Fold(name string) string {
+	mapping := is.CaseMapping()
+	if mapping == "rfc7613" {
+		return strings.ToLower(name)
+	}
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			b[i] = c + 'a' - 'A'
+		case mapping == "ascii":
+		case c == '[' || c == ']' || c == '\\':
+			b[i] = c + '{' - '['
+		case c == '~' && mapping == "rfc1459":
+			b[i] = '^'
+		}
+	}
+	return string(b)
+}
+
+// EqualFold reports whether a and b are the same nick or channel under the
+// server's casemapping
+func (is *ISupport) EqualFold(a, b string) bool {
+	return is.Fold(a) == is.Fold(b)
+}
+
+// NickLen returns the maximum nick length (default 9)
+func (is *ISupport) NickLen() int {
+	return is.getInt("NICKLEN", 9)
+}
+
+// UserLen returns the maximum length of a username (default 10)
+func (is *ISupport) UserLen() int {
+	return is.getInt("USERLEN", 10)
+}
+
+// HostLen returns the maximum length of a hostname (default 63)
+func (is *ISupport) HostLen() int {
+	return is.getInt("HOSTLEN", 63)
+}
+
+// ChannelLen returns the maximum channel name length (default 50)
+func (is *ISupport) ChannelLen() int {
+	return is.getInt("CHANNELLEN", 50)
+}
+
+// TopicLen returns the maximum topic length, 0 if unknown
+func (is *ISupport) TopicLen() int {
+	return is.getInt("TOPICLEN", 0)
+}
+
+// Modes returns how many modes with a parameter may be set in a single MODE
+// command (default 3)
+func (is *ISupport) Modes() int {
+	value, ok := is.Get("MODES")
+	if ok && value == "" {
+		// No limit, but let's be reasonable
+		return 12
+	}
+	return is.getInt("MODES", 3)
+}
+
+// TargMax returns how many targets the given command accepts, 0 means there
+// is no limit. Without TARGMAX every command takes a single target.
+func (is *ISupport) TargMax(command string) int {
+	value, ok := is.Get("TARGMAX")
+	if !ok {
+		return 1
+	}
+	for _, limit := range strings.Split(value, ",") {
+		i := strings.IndexByte(limit, ':')
+		if i < 0 || !strings.EqualFold(limit[:i], command) {
+			continue
+		}
+		n, _ := strconv.Atoi(limit[i+1:])
+		return n
+	}
+	return 1
+}
+
+// LineLen returns the maximum length of a line, including the trailing CRLF
+// and excluding tags (default 512)
+func (is *ISupport) LineLen() int {
+	return is.getInt("LINELEN", 512)
+}
+
+// Network returns the name of the network, if the server told us
+func (is *ISupport) Network() string {
+	value, _ := is.Get("NETWORK")
+	return value
+}
+
+// Monitor returns the maximum number of MONITOR targets, 0 meaning no
+// limit. The boolean is false if the server does not support MONITOR.
+func (is *ISupport) Monitor() (int, bool) {
+	if _, ok := is.Get("MONITOR"); !ok {
+		return 0, false
+	}
+	return is.getInt("MONITOR", 0), true
+}
+
+// WHOX reports whether the server supports WHO with field selection
+func (is *ISupport) WHOX() bool {
+	_, ok := is.Get("WHOX")
+	return ok
+}
+
+// ISupport returns the features advertised by the server we're connected to
+func (bot *Bot) ISupport() *ISupport {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.isupport
+}
+
+// Records the server's 005 replies
+var parseISupport = Trigger{
+	Condition: func(bot *Bot, m *Message) bool {
+		return m.Command == irc.RPL_ISUPPORT
+	},
+	Action: func(bot *Bot, m *Message) bool {
+		bot.ISupport().parse(m)
+		return false
+	},
+}
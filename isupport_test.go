@@ -0,0 +1,59 @@
+package hbot
+
+import "testing"
+
+func TestISupportParse(t *testing.T) {
+	is := newISupport()
+	is.parse(ParseMessage(":irc.example.org 005 hbot CHANTYPES=#& PREFIX=(qov)~@+ NICKLEN=30 NETWORK=Example\\x20Net EXCEPTS :are supported by this server"))
+
+	if got := is.ChanTypes(); got != "#&" {
+		t.Errorf("ChanTypes() = %q, want #&", got)
+	}
+	if modes, prefixes := is.Prefix(); modes != "qov" || prefixes != "~@+" {
+		t.Errorf("Prefix() = %q, %q, want qov, ~@+", modes, prefixes)
+	}
+	if got := is.NickLen(); got != 30 {
+		t.Errorf("NickLen() = %d, want 30", got)
+	}
+	if got := is.Network(); got != "Example Net" {
+		t.Errorf("Network() = %q, want unescaped Example Net", got)
+	}
+	if value, ok := is.Get("excepts"); !ok || value != "" {
+		t.Errorf("Get(excepts) = %q, %v, want empty and present", value, ok)
+	}
+	if !is.IsChannel("&local") || is.IsChannel("nick") {
+		t.Error("IsChannel does not follow CHANTYPES")
+	}
+
+	is.parse(ParseMessage(":irc.example.org 005 hbot -EXCEPTS :are supported by this server"))
+	if _, ok := is.Get("EXCEPTS"); ok {
+		t.Error("-EXCEPTS did not remove the token")
+	}
+}
+
+func TestISupportFold(t *testing.T) {
+	tests := []struct {
+		mapping string
+		in      string
+		want    string
+	}{
+		{"", "Nick[A]\\", "nick{a}|"},
+		{"rfc1459", "Nick[A]\\~", "nick{a}|^"},
+		{"strict-rfc1459", "Nick[A]\\~", "nick{a}|~"},
+		{"ascii", "Nick[A]\\~", "nick[a]\\~"},
+	}
+	for _, tt := range tests {
+		is := newISupport()
+		if tt.mapping != "" {
+			is.parse(ParseMessage(":irc.example.org 005 hbot CASEMAPPING=" + tt.mapping + " :are supported by this server"))
+		}
+		if got := is.Fold(tt.in); got != tt.want {
+			t.Errorf("%s: Fold(%q) = %q, want %q", tt.mapping, tt.in, got, tt.want)
+		}
+	}
+
+	is := newISupport()
+	if !is.EqualFold("nick^", "NICK~") || !is.EqualFold("[a]", "{A}") {
+		t.Error("rfc1459 EqualFold does not treat []\\~ as the upper case of {}|^")
+	}
+}
@@ -0,0 +1,278 @@
+package hbot
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps the triggers, to run code before or after them or to
+// skip them. Add middleware for all triggers with Use, or for a single one
+// with the TriggerMiddleware option.
+type Middleware func(next Handler) Handler
+
+// HandlerFunc makes a function a Handler
+type HandlerFunc func(*Bot, *Message) bool
+
+// Handle calls f(b, m)
+func (f HandlerFunc) Handle(b *Bot, m *Message) bool {
+	return f(b, m)
+}
+
+// Use adds middleware around all triggers. It runs once for every message,
+// before the triggers see it, and the first middleware added is the
+// outermost one. PINGs and the built-in trigger that joins channels are not
+// affected.
+func (bot *Bot) Use(mw ...Middleware) {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	bot.middleware = append(bot.middleware, mw...)
+}
+
+// TriggerMiddleware adds middleware around a single trigger
+func TriggerMiddleware(mw ...Middleware) TriggerOption {
+	return func(t *trigger) {
+		t.middleware = append(t.middleware, mw...)
+	}
+}
+
+// contextBound passes the context of the message being handled on to a
+// ContextHandler, through middleware that only knows about Handler
+type contextBound struct {
+	ctx context.Context
+	h   ContextHandler
+}
+
+func (c contextBound) Handle(b *Bot, m *Message) bool {
+	return c.h.HandleContext(c.ctx, b, m)
+}
+
+func (c contextBound) HandleContext(ctx context.Context, b *Bot, m *Message) bool {
+	return c.h.HandleContext(ctx, b, m)
+}
+
+// triggerLoop passes a message to triggers until one consumes it
+type triggerLoop struct {
+	triggers []*trigger
+}
+
+func (l triggerLoop) HandleContext(ctx context.Context, b *Bot, m *Message) bool {
+	for _, t := range l.triggers {
+		if b.runTrigger(ctx, t, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// withMiddleware wraps h in the bot's middleware
+func (bot *Bot) withMiddleware(h Handler) Handler {
+	bot.triggersMu.RLock()
+	mw := bot.middleware
+	bot.triggersMu.RUnlock()
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// chain wraps a trigger's handler in its own middleware
+func (t *trigger) chain(ctx context.Context) Handler {
+	var h Handler = contextBound{ctx: ctx, h: t.handler}
+	for i := len(t.middleware) - 1; i >= 0; i-- {
+		h = t.middleware[i](h)
+	}
+	return h
+}
+
+// builtinTrigger marks the bot's own triggers
+func builtinTrigger(t *trigger) {
+	t.builtin = true
+}
+
+// Logging logs every message the triggers get, and whether one consumed it
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(b *Bot, m *Message) bool {
+			consumed := next.Handle(b, m)
+			b.Info("Handled message", "command", m.Command, "from", m.From, "to", m.To, "content", m.Content, "consumed", consumed)
+			return consumed
+		})
+	}
+}
+
+// Recovery recovers from panics further down the chain, such as in other
+// middleware, and logs them. Added to a trigger with TriggerMiddleware, it
+// keeps the trigger's panics from counting towards the bot's PanicLimit.
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(b *Bot, m *Message) (consumed bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					b.Error("Trigger panicked", "panic", r, "msg", m.Raw, "stack", string(debug.Stack()))
+					consumed = false
+				}
+			}()
+			return next.Handle(b, m)
+		})
+	}
+}
+
+// Timing logs how long the triggers take to handle a message. If slow is
+// not 0, those that take slow or longer are logged as a warning.
+func Timing(slow time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(b *Bot, m *Message) bool {
+			start := time.Now()
+			consumed := next.Handle(b, m)
+			took := time.Since(start)
+			if slow > 0 && took >= slow {
+				b.Warn("Slow triggers", "command", m.Command, "from", m.From, "to", m.To, "took", took)
+			} else {
+				b.Debug("Trigger timing", "command", m.Command, "from", m.From, "to", m.To, "took", took)
+			}
+			return consumed
+		})
+	}
+}
+
+// RateLimit lets each user trigger at most n messages per period. Further
+// messages are dropped until the period is over. Messages that don't come
+// from a user, such as server numerics, are never limited.
+func RateLimit(n int, per time.Duration) Middleware {
+	type window struct {
+		start time.Time
+		count int
+	}
+	var mu sync.Mutex
+	windows := make(map[string]*window)
+
+	allow := func(b *Bot, nick string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		// Forget users that were quiet for a while
+		if len(windows) > 1024 {
+			for key, w := range windows {
+				if now.Sub(w.start) >= per {
+					delete(windows, key)
+				}
+			}
+		}
+		key := b.ISupport().Fold(nick)
+		w := windows[key]
+		if w == nil || now.Sub(w.start) >= per {
+			w = &window{start: now}
+			windows[key] = w
+		}
+		w.count++
+		return w.count <= n
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(b *Bot, m *Message) bool {
+			if m.Prefix == nil || m.Prefix.User == "" || allow(b, m.Prefix.Name) {
+				return next.Handle(b, m)
+			}
+			b.Debug("Rate limited", "from", m.From, "command", m.Command)
+			return false
+		})
+	}
+}
+
+// IgnoreList is a list of nick!user@host masks, with * and ? wildcards,
+// whose messages triggers don't see. Masks match under the server's
+// casemapping. It can be changed while the bot runs.
+type IgnoreList struct {
+	mu    sync.RWMutex
+	masks []string
+}
+
+// NewIgnoreList returns an ignore list with the given masks
+func NewIgnoreList(masks ...string) *IgnoreList {
+	l := &IgnoreList{}
+	for _, mask := range masks {
+		l.Add(mask)
+	}
+	return l
+}
+
+// Add ignores users matching mask, such as "spammer!*@*" or "*!*@bad.host"
+func (l *IgnoreList) Add(mask string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.masks = append(l.masks, mask)
+}
+
+// Remove stops ignoring mask. It returns false if mask was not in the list.
+func (l *IgnoreList) Remove(mask string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	is := newISupport()
+	for i, m := range l.masks {
+		if is.EqualFold(m, mask) {
+			l.masks = append(l.masks[:i], l.masks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether the hostmask nick!user@host is ignored, with the
+// default rfc1459 casemapping
+func (l *IgnoreList) Matches(hostmask string) bool {
+	return l.matches(newISupport(), hostmask)
+}
+
+// matches is Matches with the server's casemapping
+func (l *IgnoreList) matches(is *ISupport, hostmask string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	hostmask = is.Fold(hostmask)
+	for _, mask := range l.masks {
+		if wildcardMatch(is.Fold(mask), hostmask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware drops the messages of ignored users
+func (l *IgnoreList) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(b *Bot, m *Message) bool {
+			if m.Prefix != nil && m.Prefix.User != "" && l.matches(b.ISupport(), m.Prefix.String()) {
+				return false
+			}
+			return next.Handle(b, m)
+		})
+	}
+}
+
+// wildcardMatch matches s against a pattern where * matches any run of
+// characters and ? any single one
+func wildcardMatch(pattern, s string) bool {
+	// Position to go back to after a mismatch following the last *
+	star, retry := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, retry = p, i
+			p++
+		case star >= 0:
+			retry++
+			p, i = star+1, retry
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
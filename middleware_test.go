@@ -0,0 +1,176 @@
+package hbot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"*", "nick!user@host", true},
+		{"nick!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick2!user@host", false},
+		{"*!*@bad.host", "x!y@bad.host", true},
+		{"*!*@bad.host", "x!y@bad.host.org", false},
+		{"n?ck!*", "nick!u@h", true},
+		{"n?ck!*", "nck!u@h", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"a*", "b", false},
+		{"[x]!*@*", "[x]!u@h", true},
+	}
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitSeveralTriggers(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Use(RateLimit(3, time.Minute))
+	var seen [3]int
+	for i := range seen {
+		i := i
+		bot.AddTrigger(Trigger{
+			Condition: func(*Bot, *Message) bool { return true },
+			Action: func(*Bot, *Message) bool {
+				seen[i]++
+				return false
+			},
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		bot.runTriggers(context.Background(), ParseMessage(":alice!a@host PRIVMSG #chan :hi"))
+	}
+	for i, n := range seen {
+		if n != 3 {
+			t.Errorf("trigger %d saw %d messages, want 3", i, n)
+		}
+	}
+
+	// Other users have their own limit
+	bot.runTriggers(context.Background(), ParseMessage(":bob!b@host PRIVMSG #chan :hi"))
+	if seen[0] != 4 {
+		t.Errorf("bob was limited")
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(b *Bot, m *Message) bool {
+				order = append(order, name)
+				return next.Handle(b, m)
+			})
+		}
+	}
+	bot.Use(mark("bot1"), mark("bot2"))
+	bot.AddTrigger(Trigger{
+		Condition: func(*Bot, *Message) bool { return true },
+		Action: func(*Bot, *Message) bool {
+			order = append(order, "trigger")
+			return true
+		},
+	}, TriggerMiddleware(mark("own")))
+
+	bot.runTriggers(context.Background(), ParseMessage(":alice!a@host PRIVMSG #chan :hi"))
+	want := []string{"bot1", "bot2", "own", "trigger"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %q, want %q", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %q, want %q", order, want)
+		}
+	}
+}
+
+func TestMiddlewareSkipsBuiltinTriggers(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Use(func(Handler) Handler {
+		return HandlerFunc(func(*Bot, *Message) bool { return false })
+	})
+	bot.runTriggers(context.Background(), ParseMessage(":irc.example.org 001 hbot :Welcome"))
+	select {
+	case s := <-bot.outgoing:
+		if s != "JOIN #test" {
+			t.Errorf("sent %q, want JOIN #test", s)
+		}
+	default:
+		t.Error("channels were not joined")
+	}
+}
+
+func TestMiddlewarePanicRecovered(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Use(func(Handler) Handler {
+		return HandlerFunc(func(*Bot, *Message) bool { panic("middleware") })
+	})
+	bot.AddTrigger(Trigger{
+		Condition: func(*Bot, *Message) bool { return true },
+		Action:    func(*Bot, *Message) bool { return true },
+	})
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic escaped runTriggers: %v", r)
+		}
+	}()
+	bot.runTriggers(context.Background(), ParseMessage(":alice!a@host PRIVMSG #chan :hi"))
+}
+
+func TestIgnoreListCaseMapping(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewIgnoreList("[Foo]!*@*")
+	if !l.Matches("{foo}!u@host") {
+		t.Error("rfc1459 casemapping not applied")
+	}
+
+	var seen int
+	bot.Use(l.Middleware())
+	bot.AddTrigger(Trigger{
+		Condition: func(*Bot, *Message) bool { return true },
+		Action: func(*Bot, *Message) bool {
+			seen++
+			return true
+		},
+	})
+	bot.runTriggers(context.Background(), ParseMessage(":{FOO}!u@host PRIVMSG #chan :hi"))
+	if seen != 0 {
+		t.Error("{FOO} was not ignored under rfc1459")
+	}
+	bot.ISupport().parse(ParseMessage(":irc.example.org 005 hbot CASEMAPPING=ascii :are supported by this server"))
+	bot.runTriggers(context.Background(), ParseMessage(":{FOO}!u@host PRIVMSG #chan :hi"))
+	if seen != 1 {
+		t.Error("{FOO} was ignored under ascii casemapping")
+	}
+
+	if !l.Remove("{foo}!*@*") || l.Matches("[foo]!u@host") {
+		t.Error("mask was not removed")
+	}
+}
@@ -0,0 +1,157 @@
+package hbot
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// IRCv3 draft/multiline sends a message of several lines as a single batch
+// ref: https://ircv3.net/specs/extensions/multiline
+const (
+	multilineCap    = "draft/multiline"
+	multilineConcat = "draft/multiline-concat"
+)
+
+// multilineLine is a line of a multiline batch. concat lines continue the
+// previous one instead of starting a new line.
+type multilineLine struct {
+	text   string
+	concat bool
+}
+
+// multilineLimits parses the value of the draft/multiline capability
+func multilineLimits(value string) (maxBytes, maxLines int) {
+	for _, kv := range strings.Split(value, ",") {
+		name, v := splitCap(kv)
+		n, _ := strconv.Atoi(v)
+		switch name {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+	return maxBytes, maxLines
+}
+
+// sendMultiline sends text as draft/multiline batches. It returns false
+// without sending anything if the server can't take them, or text fits on
+// a single line anyway.
+func (bot *Bot) sendMultiline(command, who, text string) bool {
+	// The batch and concat tags need message-tags
+	if !bot.HasCap(multilineCap) || !bot.HasCap("batch") || !bot.HasCap("message-tags") {
+		return false
+	}
+	value, _ := bot.CapValue(multilineCap)
+	maxBytes, maxLines := multilineLimits(value)
+	if maxBytes <= 0 {
+		return false
+	}
+
+	// Every piece has to fit into a batch on its own
+	size := bot.maxPayload(command, who)
+	if size > maxBytes {
+		size = maxBytes
+	}
+	var lines []multilineLine
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		for i, piece := range splitConcat(strings.TrimSuffix(line, "\r"), size) {
+			lines = append(lines, multilineLine{text: piece, concat: i > 0})
+		}
+	}
+	if len(lines) < 2 {
+		return false
+	}
+
+	var batch []multilineLine
+	var length int
+	flush := func() {
+		if len(batch) == 1 {
+			// Not concatenated with anything, so the spaces it was split at
+			// would only show
+			bot.Send(command + " " + who + " :" + strings.TrimRight(batch[0].text, " "))
+		} else if len(batch) > 1 {
+			// The server rejects anything else we send while the batch is open
+			ref := bot.requests.newLabel()
+			commands := []string{"BATCH +" + ref + " " + multilineCap + " " + who}
+			for _, line := range batch {
+				tags := "@batch=" + ref
+				if line.concat {
+					tags += ";" + multilineConcat
+				}
+				commands = append(commands, tags+" "+command+" "+who+" :"+line.text)
+			}
+			bot.sendAll(append(commands, "BATCH -"+ref))
+		}
+		batch, length = nil, 0
+	}
+	for _, line := range lines {
+		n := len(line.text)
+		if len(batch) > 0 && !line.concat {
+			// The line break counts as well
+			n++
+		}
+		if len(batch) > 0 && (length+n > maxBytes || (maxLines > 0 && len(batch) == maxLines)) {
+			flush()
+			// A batch can't start with a continuation
+			line.concat = false
+			n = len(line.text)
+		}
+		batch = append(batch, line)
+		length += n
+	}
+	flush()
+	return true
+}
+
+// joinMultiline turns a complete draft/multiline batch into a single
+// message with the lines joined in its Content
+func joinMultiline(b *Batch) *Message {
+	lines := b.Messages()
+	if len(lines) == 0 {
+		return nil
+	}
+	var content, raw strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			if _, ok := line.Tags.Get(multilineConcat); !ok {
+				content.WriteByte('\n')
+			}
+			raw.WriteByte('\n')
+		}
+		content.WriteString(line.Content)
+		raw.WriteString(line.Raw)
+	}
+
+	first := lines[0]
+	m := &Message{
+		Message: &irc.Message{
+			Prefix:  first.Prefix,
+			Command: first.Command,
+			Params:  []string{first.Param(0), content.String()},
+		},
+		Content:    content.String(),
+		Raw:        raw.String(),
+		TimeStamp:  first.TimeStamp,
+		ReceivedAt: time.Now(),
+		// The batch start carries the msgid and time of the whole message
+		Tags:  b.Tags,
+		Batch: b,
+		To:    first.To,
+		From:  first.From,
+		Echo:  first.Echo,
+	}
+	if t, ok := m.ServerTime(); ok {
+		m.TimeStamp = t
+	}
+	return m
+}
+
+// isMultilinePart reports whether m is a line of a draft/multiline batch,
+// which triggers only see once joined
+func isMultilinePart(m *Message) bool {
+	return m.Batch != nil && m.Batch.Type == multilineCap && (m.Command == "PRIVMSG" || m.Command == "NOTICE")
+}
@@ -0,0 +1,67 @@
+package hbot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMultilineSmallMaxBytes(t *testing.T) {
+	bot := newTestBot(t)
+	caps := "batch message-tags draft/multiline=max-bytes=100,max-lines=3"
+	feed(bot,
+		":irc.example.org CAP * LS :"+caps,
+		":irc.example.org CAP hbot ACK :batch message-tags draft/multiline",
+	)
+	sent(bot)
+
+	text := strings.Repeat("lorem ipsum dolor sit amet ", 20)
+	bot.Msg("#chan", text)
+
+	var got strings.Builder
+	var batchBytes int
+	for _, line := range sent(bot) {
+		switch {
+		case strings.HasPrefix(line, "BATCH +"):
+			batchBytes = 0
+		case strings.HasPrefix(line, "BATCH -"):
+			if batchBytes > 100 {
+				t.Errorf("batch of %d bytes, want at most 100", batchBytes)
+			}
+		default:
+			i := strings.Index(line, " :")
+			if i < 0 {
+				t.Fatalf("unexpected line %q", line)
+			}
+			piece := line[i+2:]
+			if len(piece) > 100 {
+				t.Errorf("piece of %d bytes, want at most 100", len(piece))
+			}
+			batchBytes += len(piece)
+			if !strings.HasPrefix(line, "@batch=") {
+				if strings.HasSuffix(piece, " ") {
+					t.Errorf("line outside a batch ends in a space: %q", line)
+				}
+				piece += " "
+			}
+			got.WriteString(piece)
+		}
+	}
+	if got.String() != text {
+		t.Errorf("sent %q, want %q", got.String(), text)
+	}
+}
+
+func TestMultilineNeedsMessageTags(t *testing.T) {
+	bot := newTestBot(t)
+	feed(bot,
+		":irc.example.org CAP * LS :batch draft/multiline=max-bytes=4096",
+		":irc.example.org CAP hbot ACK :batch draft/multiline",
+	)
+	sent(bot)
+	bot.Msg("#chan", "one\ntwo")
+	for _, line := range sent(bot) {
+		if strings.HasPrefix(line, "BATCH") || strings.HasPrefix(line, "@") {
+			t.Errorf("sent %q without message-tags", line)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package hbot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// ErrNickUnavailable is returned when the server refused every nick we
+// tried during registration
+var ErrNickUnavailable = errors.New("hbot: no usable nick")
+
+// How many nicks the default generator tries before giving up
+const maxNickAttempts = 10
+
+// nickTracker follows our nick and user@host as confirmed by the server,
+// picks alternate nicks on collisions and regains the preferred nick once it
+// is free.
+type nickTracker struct {
+	mu sync.Mutex
+	// The nick we want, set from the bot's Nick and by SetNick
+	preferred string
+	// Set once the server sent 001
+	registered bool
+	// Number of nicks refused during registration
+	attempts int
+	// Set while we watch the preferred nick with MONITOR or ISON
+	monitoring bool
+	polling    bool
+}
+
+func (n *nickTracker) reset(registered bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.registered = registered
+	n.attempts = 0
+	n.monitoring = false
+	n.polling = false
+}
+
+func (n *nickTracker) getPreferred() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.preferred
+}
+
+func (n *nickTracker) setPreferred(nick string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.preferred = nick
+}
+
+func (n *nickTracker) Handle(bot *Bot, m *Message) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	is := bot.ISupport()
+
+	// Anything we did ourselves tells us our user@host
+	fromUs := m.Prefix != nil && is.EqualFold(m.Prefix.Name, bot.CurrentNick())
+	if fromUs && m.Prefix.User != "" && m.Prefix.Host != "" {
+		bot.setUserHost(m.Prefix.User, m.Prefix.Host)
+	}
+
+	switch m.Command {
+	case irc.RPL_WELCOME:
+		n.registered = true
+		bot.setNick(m.Param(0))
+		// Many servers end the welcome with our full hostmask
+		fields := strings.Fields(m.Trailing())
+		if len(fields) > 0 {
+			p := irc.ParsePrefix(fields[len(fields)-1])
+			if p.IsHostmask() && is.EqualFold(p.Name, m.Param(0)) {
+				bot.setUserHost(p.User, p.Host)
+			}
+		}
+
+	// Wait for the end of the MOTD so that we know if the server does MONITOR
+	case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD:
+		if !is.EqualFold(bot.CurrentNick(), n.preferred) {
+			n.regain(bot)
+		}
+
+	case "CHGHOST":
+		if fromUs {
+			bot.setUserHost(m.Param(0), m.Param(1))
+		}
+
+	// 396 RPL_VISIBLEHOST
+	case "396":
+		host := m.Param(1)
+		if i := strings.IndexByte(host, '@'); i >= 0 {
+			bot.setUserHost(host[:i], host[i+1:])
+		} else {
+			bot.setHost(host)
+		}
+
+	case irc.RPL_WHOREPLY:
+		// <client> <channel> <user> <host> <server> <nick> ...
+		if is.EqualFold(m.Param(5), bot.CurrentNick()) {
+			bot.setUserHost(m.Param(2), m.Param(3))
+		}
+
+	case "NICK":
+		if !fromUs {
+			return false
+		}
+		nick := m.Param(0)
+		bot.setNick(nick)
+		if is.EqualFold(nick, n.preferred) && n.monitoring {
+			n.monitoring = false
+			bot.Send("MONITOR - " + nick)
+		}
+
+	case irc.ERR_ERRONEUSNICKNAME, irc.ERR_NICKNAMEINUSE, irc.ERR_NICKCOLLISION, irc.ERR_UNAVAILRESOURCE:
+		rejected := m.Param(1)
+		if n.registered {
+			bot.Warn("Nick change refused", "nick", rejected, "reason", m.Content)
+			if is.EqualFold(rejected, n.preferred) && m.Command != irc.ERR_ERRONEUSNICKNAME {
+				n.regain(bot)
+			}
+			return false
+		}
+		next := n.next(bot, rejected)
+		if next == "" {
+			bot.abort(ErrNickUnavailable)
+			return false
+		}
+		bot.Info("Nick refused, trying another", "nick", rejected, "next", next)
+		bot.Send("NICK " + next)
+
+	// 731 RPL_MONOFFLINE
+	case "731":
+		for _, nick := range strings.Split(m.Trailing(), ",") {
+			if is.EqualFold(nick, n.preferred) && !is.EqualFold(bot.CurrentNick(), n.preferred) {
+				bot.Send("NICK " + n.preferred)
+			}
+		}
+
+	// 734 ERR_MONLISTFULL
+	case "734":
+		n.monitoring = false
+		n.poll(bot)
+
+	case irc.ERR_UNKNOWNCOMMAND:
+		if m.Param(1) == "MONITOR" {
+			n.monitoring = false
+			n.poll(bot)
+		}
+
+	case irc.RPL_ISON:
+		if !n.polling || is.EqualFold(bot.CurrentNick(), n.preferred) {
+			return false
+		}
+		for _, nick := range strings.Fields(m.Trailing()) {
+			if is.EqualFold(nick, n.preferred) {
+				return false
+			}
+		}
+		bot.Send("NICK " + n.preferred)
+	}
+	return false
+}
+
+// next returns the nick to try after rejected was refused, or "" if we ran
+// out of options
+func (n *nickTracker) next(bot *Bot, rejected string) string {
+	n.attempts++
+	if n.attempts <= len(bot.AltNicks) {
+		return bot.AltNicks[n.attempts-1]
+	}
+	if bot.NickGenerator != nil {
+		return bot.NickGenerator(rejected)
+	}
+	if n.attempts > len(bot.AltNicks)+maxNickAttempts {
+		return ""
+	}
+	return rejected + "_"
+}
+
+// regain starts watching the preferred nick so we can take it once it is
+// free. MONITOR is tried first, ISON polling is the fallback.
+func (n *nickTracker) regain(bot *Bot) {
+	if !bot.RegainNick || n.monitoring || n.polling {
+		return
+	}
+	bot.Debug("Watching preferred nick", "nick", n.preferred)
+	if _, ok := bot.ISupport().Monitor(); !ok {
+		n.poll(bot)
+		return
+	}
+	n.monitoring = true
+	bot.Send("MONITOR + " + n.preferred)
+}
+
+// poll asks the server with ISON whether our preferred nick is online until
+// the connection is closed or we have the nick
+func (n *nickTracker) poll(bot *Bot) {
+	if n.polling {
+		return
+	}
+	n.polling = true
+	ctx := bot.connContext()
+	interval := bot.NickPollInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+			preferred := n.getPreferred()
+			if bot.ISupport().EqualFold(bot.CurrentNick(), preferred) {
+				n.mu.Lock()
+				n.polling = false
+				n.mu.Unlock()
+				return
+			}
+			bot.Send("ISON " + preferred)
+		}
+	}()
+}
+
+// connContext returns a context that is cancelled when the current
+// connection is closed
+func (bot *Bot) connContext() context.Context {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.connCtx == nil {
+		return context.Background()
+	}
+	return bot.connCtx
+}
+
+// CurrentNick returns the bot's nick as confirmed by the server
+func (bot *Bot) CurrentNick() string {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.nick
+}
+
+// Hostmask returns the bot's own nick!user@host as seen by the server. The
+// user and host are only known once the server told us, until then only the
+// nick is returned.
+func (bot *Bot) Hostmask() string {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.user == "" || bot.host == "" {
+		return bot.nick
+	}
+	return bot.nick + "!" + bot.user + "@" + bot.host
+}
+
+func (bot *Bot) setNick(nick string) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.nick = nick
+}
+
+func (bot *Bot) setUserHost(user, host string) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.user = user
+	bot.host = host
+}
+
+func (bot *Bot) setHost(host string) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.host = host
+}
@@ -0,0 +1,89 @@
+package hbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNickFallback(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.AltNicks = []string{"hbot2"} })
+	feed(bot, ":irc.example.org 433 * hbot :Nickname is already in use")
+	if lines := sent(bot); count(lines, "NICK hbot2") != 1 {
+		t.Fatalf("sent %q, want the alternate nick", lines)
+	}
+	feed(bot, ":irc.example.org 433 * hbot2 :Nickname is already in use")
+	if lines := sent(bot); count(lines, "NICK hbot2_") != 1 {
+		t.Fatalf("sent %q, want an underscore appended", lines)
+	}
+	feed(bot, ":irc.example.org 001 hbot2_ :Welcome hbot2_!bot@host")
+	if nick := bot.CurrentNick(); nick != "hbot2_" {
+		t.Errorf("nick = %q, want hbot2_", nick)
+	}
+	if mask := bot.Hostmask(); mask != "hbot2_!bot@host" {
+		t.Errorf("hostmask = %q, want hbot2_!bot@host", mask)
+	}
+}
+
+func TestNickGiveUp(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) {
+		b.NickGenerator = func(string) string { return "" }
+	})
+	feed(bot, ":irc.example.org 433 * hbot :Nickname is already in use")
+	if err := bot.aborted(); err != ErrNickUnavailable {
+		t.Errorf("aborted with %v, want ErrNickUnavailable", err)
+	}
+}
+
+func TestNickRegainMonitor(t *testing.T) {
+	bot := newTestBot(t)
+	feed(bot,
+		":irc.example.org 433 * hbot :Nickname is already in use",
+		":irc.example.org 001 hbot_ :Welcome",
+		":irc.example.org 005 hbot_ MONITOR=100 :are supported by this server",
+		":irc.example.org 376 hbot_ :End of /MOTD command.",
+	)
+	if lines := sent(bot); count(lines, "MONITOR + hbot") != 1 {
+		t.Fatalf("sent %q, want MONITOR + hbot", lines)
+	}
+	feed(bot, ":irc.example.org 731 hbot_ :hbot")
+	if lines := sent(bot); count(lines, "NICK hbot") != 1 {
+		t.Fatalf("sent %q, want NICK hbot", lines)
+	}
+	feed(bot, ":hbot_!bot@host NICK :hbot")
+	if lines := sent(bot); count(lines, "MONITOR - hbot") != 1 {
+		t.Errorf("sent %q, want MONITOR - hbot", lines)
+	}
+	if nick := bot.CurrentNick(); nick != "hbot" {
+		t.Errorf("nick = %q, want hbot", nick)
+	}
+}
+
+func TestNickRegainISON(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.NickPollInterval = 10 * time.Millisecond })
+	feed(bot,
+		":irc.example.org 433 * hbot :Nickname is already in use",
+		":irc.example.org 001 hbot_ :Welcome",
+		":irc.example.org 376 hbot_ :End of /MOTD command.",
+	)
+	sent(bot)
+	select {
+	case s := <-bot.outgoing:
+		if s != "ISON hbot" {
+			t.Fatalf("sent %q, want ISON hbot", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the preferred nick was not polled")
+	}
+	// Still online
+	feed(bot, ":irc.example.org 303 hbot_ :hbot")
+	for _, s := range sent(bot) {
+		if s == "NICK hbot" {
+			t.Fatal("took a nick that is in use")
+		}
+	}
+	feed(bot, ":irc.example.org 303 hbot_ :")
+	if lines := sent(bot); count(lines, "NICK hbot") != 1 {
+		t.Fatalf("sent %q, want NICK hbot", lines)
+	}
+	feed(bot, ":hbot_!bot@host NICK :hbot")
+}
@@ -0,0 +1,83 @@
+package hbot
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Defaults for the bot's PanicLimit and PanicWindow
+const (
+	defaultPanicLimit  = 3
+	defaultPanicWindow = time.Minute
+)
+
+// runTrigger passes m to a trigger, recovering if it panics
+func (bot *Bot) runTrigger(ctx context.Context, t *trigger, m *Message) (consumed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			bot.triggerPanicked(t, m, r, debug.Stack())
+			consumed = false
+		}
+	}()
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+		start := time.Now()
+		defer func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				bot.Warn("Trigger ran past its timeout", "trigger", t.id, "name", t.name, "timeout", t.timeout, "took", time.Since(start))
+			}
+		}()
+	}
+	return t.chain(ctx).Handle(bot, m)
+}
+
+// triggerPanicked reports a panic, and disables the trigger if it panics
+// too often
+func (bot *Bot) triggerPanicked(t *trigger, m *Message, r interface{}, stack []byte) {
+	bot.Error("Trigger panicked", "trigger", t.id, "name", t.name, "panic", r, "msg", m.Raw, "stack", string(stack))
+
+	limit, window := bot.PanicLimit, bot.PanicWindow
+	if limit == 0 {
+		limit = defaultPanicLimit
+	}
+	if window <= 0 {
+		window = defaultPanicWindow
+	}
+	now := time.Now()
+
+	bot.triggersMu.Lock()
+	recent := t.panics[:0]
+	for _, at := range t.panics {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	t.panics = append(recent, now)
+	disable := limit > 0 && len(t.panics) >= limit && !t.disabled
+	if disable {
+		t.disabled = true
+		t.panics = nil
+	}
+	bot.triggersMu.Unlock()
+
+	if bot.PanicNotify != "" {
+		bot.Notice(bot.PanicNotify, fmt.Sprintf("Trigger %s panicked on %q: %v", t, m.Raw, r))
+	}
+	if disable {
+		bot.Error("Disabled trigger after repeated panics", "trigger", t.id, "name", t.name, "panics", limit, "window", window)
+		if bot.PanicNotify != "" {
+			bot.Notice(bot.PanicNotify, fmt.Sprintf("Trigger %s disabled after %d panics within %s", t, limit, window))
+		}
+	}
+}
+
+// recoverHandler logs a panic of a batch or TAGMSG handler, or of middleware
+func (bot *Bot) recoverHandler(kind string) {
+	if r := recover(); r != nil {
+		bot.Error("Handler panicked", "kind", kind, "panic", r, "stack", string(debug.Stack()))
+	}
+}
@@ -0,0 +1,102 @@
+package hbot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrQuitTimeout is returned by Quit if the server did not close the
+// connection in time. The connection is closed regardless.
+var ErrQuitTimeout = errors.New("hbot: timed out waiting for the server to close the connection")
+
+// Quit disconnects from the server. It stops accepting new messages, flushes
+// the ones that are still queued, sends QUIT with the given reason and waits
+// for the server to close the connection. After timeout the connection is
+// closed by force. Quit returns once Run has returned, right away if it
+// already did, and ErrNotRunning if it was never called.
+func (bot *Bot) Quit(reason string, timeout time.Duration) error {
+	bot.mu.Lock()
+	started := bot.runCtx != nil
+	bot.mu.Unlock()
+	if !started {
+		return ErrNotRunning
+	}
+	bot.quitOnce.Do(func() {
+		bot.mu.Lock()
+		bot.quitReason = reason
+		bot.quitTimeout = timeout
+		bot.mu.Unlock()
+		close(bot.quitting)
+	})
+
+	select {
+	case <-bot.stopped:
+	case <-time.After(timeout + time.Second):
+		return ErrQuitTimeout
+	}
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.quitErr
+}
+
+func (bot *Bot) isQuitting() bool {
+	select {
+	case <-bot.quitting:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown flushes the outgoing queue, sends QUIT and waits for the server
+// to close the connection, giving up after timeout.
+func (bot *Bot) shutdown(con net.Conn, stop chan<- string, wdone <-chan struct{}, errc <-chan error, reason string, timeout time.Duration) error {
+	bot.Info("Quitting", "reason", reason)
+	quit := "QUIT"
+	if reason != "" {
+		quit += " :" + reason
+	}
+
+	var err error
+	// Unlike a timer's channel, this stays closed once the time is up
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	deadline := ctx.Done()
+	select {
+	case stop <- quit:
+	case <-wdone:
+	case <-deadline:
+		// The writer is stuck on a server that doesn't read. Closing the
+		// connection gets it out of the write, closing stop makes it exit.
+		err = ErrQuitTimeout
+		con.Close()
+		close(stop)
+	}
+	for wdone != nil || errc != nil {
+		select {
+		case <-bot.Incoming:
+		case <-wdone:
+			wdone = nil
+		case <-errc:
+			errc = nil
+		case <-deadline:
+			// Closing the connection ends the reader, no need to do it twice
+			deadline = nil
+			err = ErrQuitTimeout
+			con.Close()
+		}
+	}
+	con.Close()
+	return err
+}
+
+func (bot *Bot) isStopped() bool {
+	select {
+	case <-bot.stopped:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,175 @@
+package hbot
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is dialed by a bot instead of a real server
+type testServer struct {
+	// Server ends of the connections the bot dialed
+	conns chan *testConn
+}
+
+// testConn is the server end of a connection
+type testConn struct {
+	net.Conn
+	// Lines the bot sent
+	lines chan string
+}
+
+func newTestServer() *testServer {
+	return &testServer{conns: make(chan *testConn, 8)}
+}
+
+func (s *testServer) dial(network, addr string) (net.Conn, error) {
+	server, client := net.Pipe()
+	c := &testConn{Conn: server, lines: make(chan string, 256)}
+	go func() {
+		defer close(c.lines)
+		scan := bufio.NewScanner(server)
+		for scan.Scan() {
+			select {
+			case c.lines <- scan.Text():
+			default:
+			}
+		}
+	}()
+	s.conns <- c
+	return client, nil
+}
+
+// accept returns the next connection the bot dialed
+func (s *testServer) accept(t *testing.T) *testConn {
+	t.Helper()
+	select {
+	case c := <-s.conns:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot did not connect")
+		return nil
+	}
+}
+
+// registered waits until the bot sent its registration, so that it has
+// nothing left to write when the test closes the connection
+func (c *testConn) registered(t *testing.T) *testConn {
+	t.Helper()
+	var user, nick bool
+	for {
+		select {
+		case line := <-c.lines:
+			user = user || strings.HasPrefix(line, "USER ")
+			nick = nick || strings.HasPrefix(line, "NICK ")
+			if user && nick {
+				return c
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("bot did not register")
+			return c
+		}
+	}
+}
+
+// send writes lines to the bot
+func (c *testConn) send(lines ...string) {
+	for _, line := range lines {
+		c.Write([]byte(line + "\r\n"))
+	}
+}
+
+// newServedBot returns a bot that connects to a new test server
+func newServedBot(t *testing.T, options ...func(*Bot)) (*Bot, *testServer) {
+	t.Helper()
+	srv := newTestServer()
+	options = append([]func(*Bot){func(b *Bot) {
+		b.Dial = srv.dial
+		b.ThrottleDelay = 0
+		b.Channels = nil
+	}}, options...)
+	bot, err := NewBot("irc.example.org", "hbot", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, srv
+}
+
+// run starts the bot and returns what RunContext returns
+func run(bot *Bot) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- bot.RunContext(context.Background())
+	}()
+	return errc
+}
+
+// wait returns the error RunContext returned
+func wait(t *testing.T, errc <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return")
+		return nil
+	}
+}
+
+func TestQuitNotRunning(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := bot.Quit("bye", time.Minute); err != ErrNotRunning {
+		t.Errorf("Quit = %v, want ErrNotRunning", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Quit took %s", time.Since(start))
+	}
+}
+
+func TestQuitFromBlockedTrigger(t *testing.T) {
+	bot, srv := newServedBot(t, func(b *Bot) {
+		b.Dispatch = DispatchSequential
+		b.DispatchQueue = 1
+	})
+	quit := make(chan error, 1)
+	bot.AddTrigger(Trigger{
+		Condition: func(b *Bot, m *Message) bool { return m.Content == "quit" },
+		Action: func(b *Bot, m *Message) bool {
+			quit <- b.Quit("bye", 200*time.Millisecond)
+			return true
+		},
+	})
+	errc := run(bot)
+	c := srv.accept(t)
+	start := time.Now()
+	// The trigger waits in Quit, the next message fills the queue and the
+	// one after holds up the reader
+	c.send(":alice!a@host PRIVMSG #chan :quit",
+		":alice!a@host PRIVMSG #chan :one",
+		":alice!a@host PRIVMSG #chan :two")
+	if err := wait(t, errc); err != nil {
+		t.Errorf("RunContext = %v, want nil", err)
+	}
+	// Not held up until Quit itself gives up
+	if took := time.Since(start); took > 800*time.Millisecond {
+		t.Errorf("RunContext returned after %s, want about the 200ms timeout", took)
+	}
+	select {
+	case err := <-quit:
+		if err != ErrQuitTimeout {
+			t.Errorf("Quit = %v, want ErrQuitTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Quit did not return")
+	}
+	if err := bot.Quit("again", time.Minute); err != ErrQuitTimeout {
+		t.Errorf("Quit after RunContext returned = %v, want the first result", err)
+	}
+}
@@ -20,16 +20,20 @@ func (bot *Bot) StartUnixListener() {
 		panic(err)
 	}
 	defer list.Close()
-	bot.unixlist = list
+	if !bot.setListener(list) {
+		return
+	}
 
 	con, err := list.AcceptUnix()
 	if err != nil {
-		fmt.Println("unix listener error: ", err)
+		if !bot.isStopped() {
+			fmt.Println("unix listener error: ", err)
+		}
 		return
 	}
 	defer con.Close()
 
-	fi, err := bot.con.(*net.TCPConn).File()
+	fi, err := bot.conn().(*net.TCPConn).File()
 	if err != nil {
 		panic(err)
 	}
@@ -39,12 +43,7 @@ func (bot *Bot) StartUnixListener() {
 		panic(err)
 	}
 
-	select {
-	case <-bot.Incoming:
-	default:
-		close(bot.Incoming)
-	}
-	close(bot.outgoing)
+	bot.handOff()
 }
 
 // Attempt to hijack session previously running bot
@@ -67,6 +66,6 @@ func (bot *Bot) hijackSession() bool {
 		panic(err)
 	}
 	bot.reconnecting = true
-	bot.con = netcon
+	bot.setConn(netcon)
 	return true
 }
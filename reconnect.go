@@ -0,0 +1,127 @@
+package hbot
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Lifecycle events are dispatched to the bot's handlers as synthetic messages
+// whose Command is one of the following values.
+const (
+	// EventDisconnected is sent when the connection to the server is lost.
+	// Content holds the error that caused the disconnect, if any.
+	EventDisconnected = "HBOT_DISCONNECTED"
+	// EventReconnecting is sent before each reconnect attempt.
+	// Params are the attempt number and the delay before dialing.
+	EventReconnecting = "HBOT_RECONNECTING"
+	// EventReconnected is sent once a new connection has been established.
+	EventReconnected = "HBOT_RECONNECTED"
+)
+
+// ReconnectPolicy controls how the bot redials the server after losing its
+// connection. Zero values are replaced by sensible defaults.
+type ReconnectPolicy struct {
+	// Maximum number of consecutive attempts, 0 means retry forever
+	MaxAttempts int
+	// Delay before the first attempt (default 1s)
+	InitialDelay time.Duration
+	// Upper bound for the delay between attempts (default 5m)
+	MaxDelay time.Duration
+	// Factor by which the delay grows after every attempt (default 2)
+	Multiplier float64
+	// Fraction of the delay that is randomized, between 0 and 1 (default 0.2)
+	Jitter float64
+	// A connection that stays up for this long resets the attempt
+	// counter (default 1m)
+	ResetAfter time.Duration
+}
+
+// AutoReconnect makes Run redial the server whenever the connection drops
+// instead of returning. Triggers and configured channels are kept.
+func AutoReconnect(p ReconnectPolicy) func(*Bot) {
+	return func(b *Bot) {
+		b.Reconnect = &p
+	}
+}
+
+// delay returns the jittered exponential backoff for the given attempt,
+// counting from zero.
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	initial, max, mult := p.InitialDelay, p.MaxDelay, p.Multiplier
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	d := math.Min(float64(initial)*math.Pow(mult, float64(attempt)), float64(max))
+	jitter := p.Jitter
+	if jitter <= 0 || jitter > 1 {
+		jitter = 0.2
+	}
+	d += d * jitter * (2*rand.Float64() - 1)
+	return time.Duration(d)
+}
+
+func (p *ReconnectPolicy) resetAfter() time.Duration {
+	if p.ResetAfter <= 0 {
+		return time.Minute
+	}
+	return p.ResetAfter
+}
+
+// redial tries to connect again according to the reconnect policy. attempts
+// holds the number of consecutive failed attempts so far and cause is the
+// error that got us here. Returns nil once we are connected, otherwise the
+// last error seen. It also returns nil if Quit was called meanwhile.
+func (bot *Bot) redial(ctx context.Context, attempts *int, cause error) error {
+	p := bot.Reconnect
+	if p == nil || bot.isHandedOff() {
+		return cause
+	}
+	for p.MaxAttempts == 0 || *attempts < p.MaxAttempts {
+		delay := p.delay(*attempts)
+		*attempts++
+		bot.Info("Reconnecting", "attempt", *attempts, "delay", delay)
+		bot.dispatchEvent(EventReconnecting, strconv.Itoa(*attempts), delay.String())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-bot.quitting:
+			return nil
+		}
+
+		if err := bot.connect(bot.Host); err != nil {
+			bot.Error("bot.Connect error", "err", err.Error(), "attempt", *attempts)
+			cause = err
+			continue
+		}
+		bot.Info("Reconnected successfully!")
+		bot.dispatchEvent(EventReconnected, bot.Host)
+		return nil
+	}
+	bot.Crit("Giving up reconnecting", "attempts", *attempts)
+	return cause
+}
+
+// dispatchEvent hands a synthetic lifecycle message to the handlers
+func (bot *Bot) dispatchEvent(command string, params ...string) {
+	now := time.Now()
+	m := &Message{
+		Message:    &irc.Message{Command: command, Params: params},
+		TimeStamp:  now,
+		ReceivedAt: now,
+	}
+	m.Content = m.Trailing()
+	// The connection may be gone already, so only shutdown cancels these
+	bot.dispatchContext(bot.runContext(), m)
+}
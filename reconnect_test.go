@@ -0,0 +1,128 @@
+package hbot
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	p := &ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.2}
+	tests := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			d := p.delay(tt.attempt)
+			min, max := tt.base*8/10, tt.base*12/10
+			if d < min || d > max {
+				t.Errorf("delay(%d) = %s, want between %s and %s", tt.attempt, d, min, max)
+			}
+		}
+	}
+}
+
+// recordEvents returns a channel receiving the lifecycle events the bot
+// dispatches, as "COMMAND param..."
+func recordEvents(bot *Bot) <-chan string {
+	events := make(chan string, 64)
+	bot.AddTrigger(Trigger{
+		Condition: func(b *Bot, m *Message) bool { return strings.HasPrefix(m.Command, "HBOT_") },
+		Action: func(b *Bot, m *Message) bool {
+			events <- strings.Join(append([]string{m.Command}, m.Params...), " ")
+			return true
+		},
+	})
+	return events
+}
+
+// nextEvent returns the next event, without the parameters that vary
+func nextEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case ev := <-events:
+		fields := strings.Fields(ev)
+		switch fields[0] {
+		case EventReconnecting:
+			// Attempt number, but not the delay
+			return fields[0] + " " + fields[1]
+		default:
+			return fields[0]
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return ""
+	}
+}
+
+func TestReconnectEvents(t *testing.T) {
+	bot, srv := newServedBot(t, func(b *Bot) {
+		b.Dispatch = DispatchSequential
+		b.Reconnect = &ReconnectPolicy{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	})
+	events := recordEvents(bot)
+	errc := run(bot)
+	srv.accept(t).registered(t).Close()
+	c := srv.accept(t)
+
+	for _, want := range []string{EventDisconnected, EventReconnecting + " 1", EventReconnected} {
+		if got := nextEvent(t, events); got != want {
+			t.Errorf("event %q, want %q", got, want)
+		}
+	}
+	// The new connection registers again
+	select {
+	case line := <-c.lines:
+		if line != "CAP LS 302" {
+			t.Errorf("first line on the new connection = %q, want CAP LS 302", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("nothing sent on the new connection")
+	}
+	bot.Quit("bye", 100*time.Millisecond)
+	wait(t, errc)
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	refused := errors.New("connection refused")
+	var dials int32
+	bot, srv := newServedBot(t, func(b *Bot) {
+		b.Dispatch = DispatchSequential
+		b.Reconnect = &ReconnectPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	})
+	bot.Dial = func(network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			return nil, refused
+		}
+		return srv.dial(network, addr)
+	}
+	events := recordEvents(bot)
+	errc := run(bot)
+	srv.accept(t).registered(t).Close()
+
+	if err := wait(t, errc); !errors.Is(err, refused) {
+		t.Errorf("RunContext = %v, want the dial error", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Errorf("dialed %d times, want 1 + 2 attempts", n)
+	}
+	for _, want := range []string{EventDisconnected, EventReconnecting + " 1", EventReconnecting + " 2"} {
+		if got := nextEvent(t, events); got != want {
+			t.Errorf("event %q, want %q", got, want)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %q after giving up", ev)
+	default:
+	}
+}
@@ -0,0 +1,395 @@
+package hbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a reply may wait for the numeric that completes its end, see
+// replySet.mayEnd
+const replyEndWait = time.Second
+
+// replySet describes which numerics answer a command, for servers without
+// labeled-response
+type replySet struct {
+	// Numerics that are part of the answer
+	replies []string
+	// Numerics that end the answer, with the index of the param naming the
+	// command's target, or -1 if the target isn't checked
+	ends map[string]int
+	// Numerics that end the answer unless one of ends follows right after,
+	// with the index of the param naming the command's target
+	mayEnd map[string]int
+	// Optional check whether the command gets a numeric reply with these
+	// arguments at all, e.g. a MODE query but not a mode change
+	answered func(args []string) bool
+}
+
+var knownReplies = map[string]replySet{
+	"WHOIS": {
+		replies: []string{"276", "301", "307", "310", "311", "312", "313", "317", "319", "320", "330", "338", "378", "379", "671"},
+		ends:    map[string]int{"318": 1},
+	},
+	"WHOWAS": {replies: []string{"312", "314", "330", "338"}, ends: map[string]int{"369": 1}},
+	"WHO":    {replies: []string{"352", "354"}, ends: map[string]int{"315": 1}},
+	"NAMES":  {replies: []string{"353"}, ends: map[string]int{"366": 1}},
+	"TOPIC": {
+		// Not every server sends 333 RPL_TOPICWHOTIME after the topic
+		mayEnd:   map[string]int{"332": 1},
+		ends:     map[string]int{"331": 1, "333": 1},
+		answered: func(args []string) bool { return len(args) == 1 },
+	},
+	"MODE": {
+		replies: []string{"346", "348", "367"},
+		// RPL_UMODEIS is sent to the user whose modes were asked for
+		ends:     map[string]int{"221": 0, "324": 1, "347": 1, "349": 1, "368": 1},
+		answered: isModeQuery,
+	},
+	"INVITE":   {ends: map[string]int{"341": -1}},
+	"LIST":     {replies: []string{"321", "322"}, ends: map[string]int{"323": -1}},
+	"ISON":     {ends: map[string]int{"303": -1}},
+	"USERHOST": {ends: map[string]int{"302": -1}},
+	"AWAY":     {ends: map[string]int{"305": -1, "306": -1}},
+	"TIME":     {ends: map[string]int{"391": -1}},
+	"MOTD":     {replies: []string{"375", "372"}, ends: map[string]int{"376": -1, "422": -1}},
+	"LUSERS":   {replies: []string{"251", "252", "253", "254", "255", "265"}, ends: map[string]int{"266": -1}},
+	"PING":     {ends: map[string]int{"PONG": -1}},
+}
+
+// isModeQuery reports whether MODE with args asks for modes or a list of
+// bans, exceptions or invites, rather than changing them
+func isModeQuery(args []string) bool {
+	switch len(args) {
+	case 1:
+		return true
+	case 2:
+		switch strings.TrimPrefix(args[1], "+") {
+		case "b", "e", "I":
+			return true
+		}
+	}
+	return false
+}
+
+// requestTracker matches replies to the commands sent with Request
+type requestTracker struct {
+	mu   sync.Mutex
+	next uint64
+	// Requests waiting for their reply, by label
+	labels map[string]chan []*Message
+	// Labeled reply batches in progress, by batch reference tag
+	batches map[string]labeledBatch
+	// The request waiting for a reply without labeled-response. There can
+	// only be one at a time, sem holds the token while it waits.
+	sem     chan struct{}
+	matcher *replyMatcher
+	// A request that ended with an error, whose end numeric may still
+	// follow
+	failed *replyMatcher
+	// Functions looking at every message until they return true
+	watchers map[uint64]func(*Message) bool
+}
+
+type labeledBatch struct {
+	label string
+	batch *Batch
+}
+
+// replyMatcher collects the reply to a request by its numerics
+type replyMatcher struct {
+	replySet
+	verb   string
+	target string
+	msgs   []*Message
+	done   chan []*Message
+	// Set while the end of the reply waits for what follows it
+	held  bool
+	timer *time.Timer
+	// Set if the reply ended with an error
+	failed bool
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{
+		labels:   make(map[string]chan []*Message),
+		batches:  make(map[string]labeledBatch),
+		sem:      make(chan struct{}, 1),
+		watchers: make(map[uint64]func(*Message) bool),
+	}
+}
+
+func (r *requestTracker) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = make(map[string]labeledBatch)
+}
+
+// newLabel returns a unique label for a request
+func (r *requestTracker) newLabel() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nextLabel()
+}
+
+func (r *requestTracker) nextLabel() string {
+	r.next++
+	return "hbot" + strconv.FormatUint(r.next, 36)
+}
+
+// add registers a new labeled request
+func (r *requestTracker) add() (string, chan []*Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	label := r.nextLabel()
+	done := make(chan []*Message, 1)
+	r.labels[label] = done
+	return label, done
+}
+
+// watch calls fn with every incoming message, with r.mu held, until it
+// returns true or the returned stop function is called
+func (r *requestTracker) watch(fn func(*Message) bool) (stop func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	id := r.next
+	r.watchers[id] = fn
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.watchers, id)
+	}
+}
+
+func (r *requestTracker) remove(label string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.labels, label)
+}
+
+func (r *requestTracker) setMatcher(rm *replyMatcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.matcher = rm
+}
+
+// finish hands the reply to a labeled request, with r.mu held
+func (r *requestTracker) finish(label string, msgs []*Message) {
+	if done, ok := r.labels[label]; ok {
+		delete(r.labels, label)
+		done <- msgs
+	}
+}
+
+func (r *requestTracker) Handle(bot *Bot, m *Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, fn := range r.watchers {
+		if fn(m) {
+			delete(r.watchers, id)
+		}
+	}
+
+	if label, ok := m.Tags.Get("label"); ok && r.labels[label] != nil {
+		switch {
+		case m.Command == "ACK":
+			r.finish(label, []*Message{})
+		case m.Command == "BATCH" && strings.HasPrefix(m.Param(0), "+") && m.Param(1) == "labeled-response":
+			id := m.Param(0)[1:]
+			r.batches[id] = labeledBatch{label: label, batch: bot.batches.get(id)}
+		default:
+			r.finish(label, []*Message{m})
+		}
+		return false
+	}
+
+	if m.Command == "BATCH" && strings.HasPrefix(m.Param(0), "-") {
+		id := m.Param(0)[1:]
+		if lb, ok := r.batches[id]; ok {
+			delete(r.batches, id)
+			var msgs []*Message
+			if lb.batch != nil {
+				msgs = lb.batch.Messages()
+			}
+			r.finish(lb.label, msgs)
+		}
+		return false
+	}
+
+	if rm := r.failed; rm != nil {
+		r.failed = nil
+		// The server ends the reply as usual after the error
+		if i, ok := rm.ends[m.Command]; ok && rm.targets(bot.ISupport(), m, i) {
+			return false
+		}
+	}
+
+	if rm := r.matcher; rm != nil {
+		rm.match(bot, m)
+		if rm.held && rm.timer == nil {
+			rm.timer = time.AfterFunc(replyEndWait, func() {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				rm.release()
+			})
+		}
+		if rm.failed {
+			r.failed = rm
+			r.matcher = nil
+		}
+	}
+	return false
+}
+
+// match adds m to the reply if it is part of it
+func (rm *replyMatcher) match(bot *Bot, m *Message) {
+	if rm.done == nil {
+		return
+	}
+	is := bot.ISupport()
+	if rm.held {
+		if i, ok := rm.ends[m.Command]; ok && rm.targets(is, m, i) {
+			rm.end(m)
+		} else {
+			rm.release()
+		}
+		return
+	}
+	// Errors end the request they are about
+	if isErrorReply(m) {
+		if rm.namedBy(is, m) {
+			rm.failed = true
+			rm.end(m)
+		}
+		return
+	}
+	if i, ok := rm.ends[m.Command]; ok {
+		if rm.targets(is, m, i) {
+			rm.end(m)
+		}
+		return
+	}
+	if i, ok := rm.mayEnd[m.Command]; ok && rm.targets(is, m, i) {
+		rm.msgs = append(rm.msgs, m)
+		rm.held = true
+		return
+	}
+	for _, reply := range rm.replies {
+		if m.Command == reply {
+			rm.msgs = append(rm.msgs, m)
+			return
+		}
+	}
+}
+
+// targets reports whether param i of m names the request's target, if it
+// needs to
+func (rm *replyMatcher) targets(is *ISupport, m *Message, i int) bool {
+	return i < 0 || rm.target == "" || is.EqualFold(m.Param(i), rm.target)
+}
+
+// namedBy reports whether the error m names the request's command or target
+// among its params, other than our nick and the error text
+func (rm *replyMatcher) namedBy(is *ISupport, m *Message) bool {
+	for i := 1; i < len(m.Params)-1; i++ {
+		p := m.Params[i]
+		if strings.EqualFold(p, rm.verb) || (rm.target != "" && is.EqualFold(p, rm.target)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isErrorReply reports whether m is an error numeric
+func isErrorReply(m *Message) bool {
+	return len(m.Command) == 3 && (m.Command[0] == '4' || m.Command[0] == '5')
+}
+
+func (rm *replyMatcher) end(m *Message) {
+	rm.done <- append(rm.msgs, m)
+	rm.done = nil
+}
+
+// release ends a reply whose end was held back with what it has
+func (rm *replyMatcher) release() {
+	if rm.held && rm.done != nil {
+		rm.done <- rm.msgs
+		rm.done = nil
+	}
+}
+
+// Request sends a command and returns the server's reply to it, such as the
+// numerics answering a WHOIS. Error replies are returned like any other.
+//
+// With the labeled-response capability the server tells us exactly which
+// messages answer the command, and an empty reply means the server merely
+// acknowledged it. Without it, the reply is recognized by its numerics,
+// which only works for well known queries and one request at a time.
+// Commands answered without a numeric, such as a mode change, return an
+// error then.
+func (bot *Bot) Request(ctx context.Context, cmd string) ([]*Message, error) {
+	connCtx := bot.connContext()
+	wait := func(done <-chan []*Message) ([]*Message, error) {
+		select {
+		case msgs := <-done:
+			return msgs, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-connCtx.Done():
+			return nil, ErrConnectionLost
+		}
+	}
+
+	if bot.HasCap("labeled-response") {
+		label, done := bot.requests.add()
+		defer bot.requests.remove(label)
+		bot.Send("@label=" + label + " " + cmd)
+		return wait(done)
+	}
+
+	done := make(chan []*Message, 1)
+	rm, err := newReplyMatcher(cmd, done)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case bot.requests.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-bot.requests.sem }()
+	bot.requests.setMatcher(rm)
+	defer bot.requests.setMatcher(nil)
+	bot.Send(cmd)
+	return wait(done)
+}
+
+// newReplyMatcher returns a matcher for the reply to cmd, which is sent to
+// done
+func newReplyMatcher(cmd string, done chan []*Message) (*replyMatcher, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return nil, errors.New("hbot: empty request")
+	}
+	verb := strings.ToUpper(fields[0])
+	known, ok := knownReplies[verb]
+	if !ok || (known.answered != nil && !known.answered(fields[1:])) {
+		return nil, fmt.Errorf("hbot: can't tell the reply to %s without labeled-response", verb)
+	}
+	rm := &replyMatcher{replySet: known, verb: verb, done: done}
+	if len(fields) > 1 {
+		rm.target = fields[1]
+		if verb == "WHOIS" {
+			// WHOIS [<server>] <nick>
+			rm.target = fields[len(fields)-1]
+		}
+	}
+	return rm, nil
+}
@@ -0,0 +1,188 @@
+package hbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplyMatcher(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		in   []string
+		// Number of messages in the reply, or 0 if it must not end
+		want int
+	}{
+		{
+			name: "whois",
+			cmd:  "WHOIS alice",
+			in: []string{
+				":irc.example.org 311 hbot alice a host * :Alice",
+				":irc.example.org 318 hbot bob :End of /WHOIS list",
+				":irc.example.org 318 hbot Alice :End of /WHOIS list",
+			},
+			want: 2,
+		},
+		{
+			name: "own user modes",
+			cmd:  "MODE hbot",
+			in:   []string{":irc.example.org 221 hbot +iw"},
+			want: 1,
+		},
+		{
+			name: "channel modes",
+			cmd:  "MODE #chan",
+			in: []string{
+				":irc.example.org 221 hbot +iw",
+				":irc.example.org 324 hbot #chan +nt",
+			},
+			want: 1,
+		},
+		{
+			name: "ban list",
+			cmd:  "MODE #chan +b",
+			in: []string{
+				":irc.example.org 367 hbot #chan *!*@bad.host op 1600000000",
+				":irc.example.org 368 hbot #chan :End of channel ban list",
+			},
+			want: 2,
+		},
+		{
+			name: "unrelated error",
+			cmd:  "MODE #chan",
+			in:   []string{":irc.example.org 421 hbot CAP :Unknown command"},
+		},
+		{
+			name: "error naming the target",
+			cmd:  "MODE #chan",
+			in:   []string{":irc.example.org 403 hbot #Chan :No such channel"},
+			want: 1,
+		},
+		{
+			name: "error naming the command",
+			cmd:  "WHO",
+			in:   []string{":irc.example.org 461 hbot WHO :Not enough parameters"},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bot, err := NewBot("irc.example.org", "hbot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan []*Message, 1)
+			rm, err := newReplyMatcher(tt.cmd, done)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range tt.in {
+				rm.match(bot, ParseMessage(line))
+			}
+			select {
+			case msgs := <-done:
+				if len(msgs) != tt.want {
+					t.Errorf("reply has %d messages, want %d", len(msgs), tt.want)
+				}
+			default:
+				if tt.want != 0 {
+					t.Error("reply did not end")
+				}
+			}
+		})
+	}
+}
+
+func TestReplyMatcherUnanswered(t *testing.T) {
+	for _, cmd := range []string{"MODE #chan +o alice", "MODE hbot +i", "TOPIC #chan :new topic", "PRIVMSG #chan :hi", ""} {
+		if _, err := newReplyMatcher(cmd, make(chan []*Message, 1)); err == nil {
+			t.Errorf("%q: no error for a command without a numeric reply", cmd)
+		}
+	}
+	for _, cmd := range []string{"MODE #chan", "MODE #chan b", "TOPIC #chan", "WHOIS irc.example.org alice"} {
+		if _, err := newReplyMatcher(cmd, make(chan []*Message, 1)); err != nil {
+			t.Errorf("%q: %v", cmd, err)
+		}
+	}
+}
+
+// startRequest sets up the tracker as Request does without labeled-response
+func startRequest(t *testing.T, bot *Bot, cmd string) chan []*Message {
+	t.Helper()
+	done := make(chan []*Message, 1)
+	rm, err := newReplyMatcher(cmd, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.requests.setMatcher(rm)
+	return done
+}
+
+// reply returns the reply sent to done, or nil if there is none yet
+func reply(done chan []*Message) []*Message {
+	select {
+	case msgs := <-done:
+		return msgs
+	default:
+		return nil
+	}
+}
+
+func TestReplyTopic(t *testing.T) {
+	bot := newTestBot(t)
+	done := startRequest(t, bot, "TOPIC #chan")
+	feed(bot, ":irc.example.org 332 hbot #chan :the topic")
+	if msgs := reply(done); msgs != nil {
+		t.Fatalf("reply ended before 333 could follow: %d messages", len(msgs))
+	}
+	feed(bot, ":irc.example.org 333 hbot #chan alice 1600000000")
+	if msgs := reply(done); len(msgs) != 2 {
+		t.Errorf("reply has %d messages, want 332 and 333", len(msgs))
+	}
+
+	// Servers without 333
+	done = startRequest(t, bot, "TOPIC #chan")
+	feed(bot,
+		":irc.example.org 332 hbot #chan :the topic",
+		":alice!a@host PRIVMSG #chan :hi",
+	)
+	if msgs := reply(done); len(msgs) != 1 || msgs[0].Command != "332" {
+		t.Errorf("reply = %v, want 332 alone", msgs)
+	}
+
+	// Nothing follows at all
+	done = startRequest(t, bot, "TOPIC #chan")
+	feed(bot, ":irc.example.org 332 hbot #chan :the topic")
+	select {
+	case msgs := <-done:
+		if len(msgs) != 1 {
+			t.Errorf("reply has %d messages, want 1", len(msgs))
+		}
+	case <-time.After(2 * replyEndWait):
+		t.Error("reply did not end without 333")
+	}
+}
+
+func TestReplyEndAfterError(t *testing.T) {
+	bot := newTestBot(t)
+	done := startRequest(t, bot, "WHOIS alice")
+	feed(bot, ":irc.example.org 401 hbot alice :No such nick/channel")
+	if msgs := reply(done); len(msgs) != 1 || msgs[0].Command != "401" {
+		t.Fatalf("reply = %v, want 401", msgs)
+	}
+	bot.requests.setMatcher(nil)
+
+	// The 318 that follows the error belongs to the first request
+	done = startRequest(t, bot, "WHOIS alice")
+	feed(bot, ":irc.example.org 318 hbot alice :End of /WHOIS list")
+	if msgs := reply(done); msgs != nil {
+		t.Fatal("the next request got the end of the failed one")
+	}
+	feed(bot,
+		":irc.example.org 311 hbot alice a host * :Alice",
+		":irc.example.org 318 hbot alice :End of /WHOIS list",
+	)
+	if msgs := reply(done); len(msgs) != 2 {
+		t.Errorf("reply has %d messages, want 2", len(msgs))
+	}
+}
@@ -1,69 +1,347 @@
 package hbot
 
 import (
-	"bytes"
 	"encoding/base64"
+	"errors"
 	"strings"
 	"sync"
 )
 
+// AUTHENTICATE payloads are sent in chunks of this many bytes
+const saslChunkSize = 400
+
+// SASLMechanism is a SASL authentication mechanism. Set the bot's
+// SASLMechanisms to choose which ones are used and in what order.
+type SASLMechanism interface {
+	// Name of the mechanism, as sent in AUTHENTICATE
+	Name() string
+	// Start begins a new authentication and returns the initial response
+	Start() ([]byte, error)
+	// Next returns the response to a challenge from the server
+	Next(challenge []byte) ([]byte, error)
+}
+
+type saslPlain struct {
+	user, pass string
+}
+
+// SASLPlain returns the PLAIN mechanism, which sends the password in clear
+// text. Only use it over SSL connections.
+func SASLPlain(user, pass string) SASLMechanism {
+	return &saslPlain{user: user, pass: pass}
+}
+
+func (p *saslPlain) Name() string { return "PLAIN" }
+
+func (p *saslPlain) Start() ([]byte, error) {
+	return []byte(p.user + "\x00" + p.user + "\x00" + p.pass), nil
+}
+
+func (p *saslPlain) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("hbot: unexpected SASL PLAIN challenge")
+}
+
+type saslExternal struct{}
+
+// SASLExternal returns the EXTERNAL mechanism, which authenticates with the
+// client certificate from the bot's TLSConfig.
+func SASLExternal() SASLMechanism {
+	return saslExternal{}
+}
+
+func (saslExternal) Name() string { return "EXTERNAL" }
+
+func (saslExternal) Start() ([]byte, error) {
+	return nil, nil
+}
+
+func (saslExternal) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("hbot: unexpected SASL EXTERNAL challenge")
+}
+
+// SASLFailurePolicy decides what happens when SASL authentication fails
+type SASLFailurePolicy int
+
+const (
+	// SASLContinue registers without logging in to an account
+	SASLContinue SASLFailurePolicy = iota
+	// SASLAbort closes the connection, RunContext returns a *SASLError
+	SASLAbort
+	// SASLRetry tries the next mechanism the server supports, and aborts
+	// like SASLAbort once there are none left
+	SASLRetry
+)
+
 type saslAuth struct {
 	mu     sync.Mutex
 	enable bool
 	user   string
 	pass   string
+
+	// Mechanism of the exchange in progress
+	mech SASLMechanism
+	// Set once the initial response was sent
+	started bool
+	// Challenge received so far, the server splits it like we do
+	challenge strings.Builder
+	// Mechanisms the server told us about in 908 RPL_SASLMECHS
+	serverMechs []string
+	// Mechanisms that failed on this connection
+	tried map[string]bool
 }
 
 func (h *saslAuth) SetAuth(user, pass string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.enable = true
 	h.user = user
 	h.pass = pass
+	h.serverMechs = nil
+	h.tried = make(map[string]bool)
+}
+
+func (h *saslAuth) isEnabled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.enable
+}
+
+func isSASLAck(m *Message) bool {
+	if m.Command != "CAP" || m.Param(1) != "ACK" {
+		return false
+	}
+	for _, cp := range strings.Fields(m.Content) {
+		if cp == "sasl" {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *saslAuth) IsAuthMessage(m *Message) bool {
-	return (strings.TrimSpace(m.Content) == "sasl" && m.Param(1) == "ACK") ||
-		(m.Command == "AUTHENTICATE" && m.Param(0) == "+") ||
-		(m.Command == "903" || m.Command == "904")
+	if isSASLAck(m) || m.Command == "AUTHENTICATE" {
+		return true
+	}
+	switch m.Command {
+	case "902", "903", "904", "905", "906", "907", "908":
+		return true
+	}
+	return false
 }
 
 func (h *saslAuth) Handle(bot *Bot, m *Message) bool {
+	switch m.Command {
+	// 900 RPL_LOGGEDIN
+	case "900":
+		bot.setAccount(m.Param(2))
+	// 901 RPL_LOGGEDOUT
+	case "901":
+		bot.setAccount("")
+	}
 
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if !h.IsAuthMessage(m) {
+	if !h.isEnabled() || !h.IsAuthMessage(m) {
 		return false
 	}
 
-	if strings.TrimSpace(m.Content) == "sasl" && m.Param(1) == "ACK" {
-		bot.Debug("Recieved SASL ACK")
-		bot.Send("AUTHENTICATE PLAIN")
+	h.mu.Lock()
+	done := h.handle(bot, m)
+	h.mu.Unlock()
+	if done {
+		bot.caps.saslDone(bot)
 	}
+	return false
+}
+
+// handle processes a SASL related message with h.mu held. It returns true
+// once authentication is over.
+func (h *saslAuth) handle(bot *Bot, m *Message) bool {
+	switch {
+	case isSASLAck(m):
+		bot.Debug("Recieved SASL ACK")
+		return h.begin(bot)
 
-	if m.Command == "AUTHENTICATE" && m.Param(0) == "+" {
+	case m.Command == "AUTHENTICATE":
+		if h.mech == nil {
+			return false
+		}
 		bot.Debug("Got auth message!")
-		out := bytes.Join([][]byte{[]byte(h.user), []byte(h.user), []byte(h.pass)}, []byte{0})
-		encpass := base64.StdEncoding.EncodeToString(out)
-		bot.Send("AUTHENTICATE " + encpass)
-	}
+		chunk := m.Param(0)
+		if chunk != "+" {
+			h.challenge.WriteString(chunk)
+		}
+		// A full chunk means more is coming
+		if len(chunk) == saslChunkSize {
+			return false
+		}
+		challenge, err := base64.StdEncoding.DecodeString(h.challenge.String())
+		h.challenge.Reset()
+		var resp []byte
+		if err == nil {
+			if h.started {
+				resp, err = h.mech.Next(challenge)
+			} else {
+				h.started = true
+				resp, err = h.mech.Start()
+			}
+		}
+		if err != nil {
+			bot.Error("SASL authentication failed", "mechanism", h.mech.Name(), "err", err)
+			bot.Send("AUTHENTICATE *")
+			return false
+		}
+		for _, line := range saslChunks(resp) {
+			bot.Send("AUTHENTICATE " + line)
+		}
 
 	// 903 RPL_SASLSUCCESS
+	// 907 ERR_SASLALREADY
+	case m.Command == "903" || m.Command == "907":
+		bot.Info("SASL authentication succeeded", "msg", m.Content)
+		h.mech = nil
+		return true
+
+	// 902 ERR_NICKLOCKED
 	// 904 ERR_SASLFAIL
-	if m.Command == "903" || m.Command == "904" {
-		bot.Send("CAP END")
+	// 905 ERR_SASLTOOLONG
+	// 906 ERR_SASLABORTED
+	case m.Command == "902" || m.Command == "904" || m.Command == "905" || m.Command == "906":
+		err := &SASLError{Numeric: m.Command, Text: m.Content}
+		if h.mech != nil {
+			err.Mechanism = h.mech.Name()
+			h.tried[h.mech.Name()] = true
+		}
+		h.mech = nil
+		retry := m.Command == "904" || m.Command == "906"
+		if retry && bot.SASLFailure == SASLRetry && h.pickMechanism(bot) != nil {
+			bot.Info("SASL authentication failed, trying next mechanism", "err", err)
+			return h.begin(bot)
+		}
+		return h.fail(bot, err)
+
+	// 908 RPL_SASLMECHS
+	case m.Command == "908":
+		h.serverMechs = strings.Split(m.Param(1), ",")
+	}
+	return false
+}
+
+// begin starts authenticating with the best mechanism we did not try yet
+func (h *saslAuth) begin(bot *Bot) bool {
+	h.mech = h.pickMechanism(bot)
+	if h.mech == nil {
+		return h.fail(bot, &SASLError{Text: "no usable mechanism, server offers " + strings.Join(h.offered(bot), ",")})
 	}
+	h.started = false
+	h.challenge.Reset()
+	bot.Send("AUTHENTICATE " + h.mech.Name())
+	return false
+}
 
+// fail applies the bot's SASLFailure policy. It returns true if registration
+// should continue without an account.
+func (h *saslAuth) fail(bot *Bot, err *SASLError) bool {
+	if bot.SASLFailure == SASLContinue {
+		bot.Error("SASL authentication failed, continuing without account", "err", err)
+		return true
+	}
+	bot.abort(err)
 	return false
 }
 
-// SASLAuthenticate performs SASL authentication
+// unavailable is called when the server can't do SASL at all
+func (h *saslAuth) unavailable(bot *Bot) {
+	if !h.isEnabled() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fail(bot, &SASLError{Text: "server does not support SASL"})
+}
+
+// pickMechanism returns the first of the bot's mechanisms that the server
+// supports and that did not fail yet. If we don't know what the server
+// supports, it returns the first one that did not fail.
+func (h *saslAuth) pickMechanism(bot *Bot) SASLMechanism {
+	mechs := bot.SASLMechanisms
+	if len(mechs) == 0 {
+		mechs = []SASLMechanism{SASLPlain(h.user, h.pass)}
+	}
+	offered := h.offered(bot)
+	for _, mech := range mechs {
+		if h.tried[mech.Name()] {
+			continue
+		}
+		if len(offered) == 0 {
+			return mech
+		}
+		for _, name := range offered {
+			if strings.EqualFold(mech.Name(), name) {
+				return mech
+			}
+		}
+	}
+	return nil
+}
+
+// offered returns the mechanisms the server supports, from 908 or the value
+// of the sasl capability
+func (h *saslAuth) offered(bot *Bot) []string {
+	if len(h.serverMechs) > 0 {
+		return h.serverMechs
+	}
+	if value, _ := bot.CapValue("sasl"); value != "" {
+		return strings.Split(value, ",")
+	}
+	return nil
+}
+
+// saslChunks base64 encodes a response and splits it into AUTHENTICATE
+// arguments
+func saslChunks(resp []byte) []string {
+	enc := base64.StdEncoding.EncodeToString(resp)
+	var lines []string
+	for len(enc) >= saslChunkSize {
+		lines = append(lines, enc[:saslChunkSize])
+		enc = enc[saslChunkSize:]
+	}
+	// An empty or exactly chunk sized payload ends with "+"
+	if enc == "" {
+		enc = "+"
+	}
+	return append(lines, enc)
+}
+
+// SaslMechanisms makes the bot authenticate with the first of the given
+// mechanisms that the server supports.
+func SaslMechanisms(mechs ...SASLMechanism) func(*Bot) {
+	return func(b *Bot) {
+		b.SASL = true
+		b.SASLMechanisms = mechs
+	}
+}
+
+// SASLAuthenticate performs SASL authentication. The user and password are
+// used with PLAIN unless the bot's SASLMechanisms are set.
 // ref: https://github.com/atheme/charybdis/blob/master/doc/sasl.txt
 func (bot *Bot) SASLAuthenticate(user, pass string) {
 	bot.sasl.SetAuth(user, pass)
-	bot.addSASL.Do(func() { bot.AddTrigger(bot.sasl) })
 	bot.Debug("Beginning SASL Authentication")
-	bot.Send("CAP REQ :sasl")
-	bot.SetNick(bot.Nick)
-	bot.sendUserCommand(bot.Nick, bot.Nick)
+	bot.beginCapNegotiation()
+	nick := bot.nicks.getPreferred()
+	bot.SetNick(nick)
+	bot.sendUserCommand(nick, nick)
+}
+
+// Account returns the account the bot is logged in to, as reported by
+// 900 RPL_LOGGEDIN. It is empty if we are not logged in.
+func (bot *Bot) Account() string {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.account
+}
+
+func (bot *Bot) setAccount(account string) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.account = account
 }
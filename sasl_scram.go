@@ -0,0 +1,147 @@
+package hbot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// saslScram implements SCRAM authentication
+// ref: https://tools.ietf.org/html/rfc5802 and https://tools.ietf.org/html/rfc7677
+type saslScram struct {
+	name       string
+	hash       func() hash.Hash
+	user, pass string
+
+	// State of the exchange in progress
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// SASLScramSHA1 returns the SCRAM-SHA-1 mechanism
+func SASLScramSHA1(user, pass string) SASLMechanism {
+	return &saslScram{name: "SCRAM-SHA-1", hash: sha1.New, user: user, pass: pass}
+}
+
+// SASLScramSHA256 returns the SCRAM-SHA-256 mechanism
+func SASLScramSHA256(user, pass string) SASLMechanism {
+	return &saslScram{name: "SCRAM-SHA-256", hash: sha256.New, user: user, pass: pass}
+}
+
+func (s *saslScram) Name() string { return s.name }
+
+func (s *saslScram) Start() ([]byte, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s.step = 1
+	s.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	s.clientFirstBare = "n=" + scramEscape(s.user) + ",r=" + s.clientNonce
+	s.serverSignature = nil
+	return []byte("n,," + s.clientFirstBare), nil
+}
+
+func (s *saslScram) Next(challenge []byte) ([]byte, error) {
+	attrs := scramAttrs(string(challenge))
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("hbot: %s server error: %s", s.name, e)
+	}
+
+	switch s.step {
+	case 1:
+		s.step = 2
+		nonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+		if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+			return nil, errors.New("hbot: " + s.name + " server nonce mismatch")
+		}
+		salt, err := base64.StdEncoding.DecodeString(salt64)
+		if err != nil {
+			return nil, fmt.Errorf("hbot: %s bad salt: %w", s.name, err)
+		}
+		iterations, err := strconv.Atoi(iter)
+		if err != nil || iterations < 1 {
+			return nil, errors.New("hbot: " + s.name + " bad iteration count")
+		}
+
+		// "biws" is the base64 encoded GS2 header "n,,"
+		clientFinal := "c=biws,r=" + nonce
+		authMessage := s.clientFirstBare + "," + string(challenge) + "," + clientFinal
+
+		salted := pbkdf2(s.hash, []byte(s.pass), salt, iterations)
+		clientKey := s.hmac(salted, "Client Key")
+		storedKey := s.sum(clientKey)
+		proof := s.hmac(storedKey, authMessage)
+		for i := range proof {
+			proof[i] ^= clientKey[i]
+		}
+		s.serverSignature = s.hmac(s.hmac(salted, "Server Key"), authMessage)
+		return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+
+	case 2:
+		s.step = 3
+		v, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(v, s.serverSignature) {
+			return nil, errors.New("hbot: " + s.name + " server signature mismatch")
+		}
+		return nil, nil
+	}
+	return nil, errors.New("hbot: unexpected " + s.name + " challenge")
+}
+
+func (s *saslScram) hmac(key []byte, msg string) []byte {
+	mac := hmac.New(s.hash, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func (s *saslScram) sum(b []byte) []byte {
+	h := s.hash()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// scramEscape escapes a username as a SCRAM saslname
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// scramAttrs parses a comma separated list of SCRAM attributes
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) > 1 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+	return attrs
+}
+
+// pbkdf2 derives a key as long as the hash output, which is all SCRAM needs
+// ref: https://tools.ietf.org/html/rfc2898#section-5.2
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	prf := hmac.New(h, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	out := make([]byte, len(u))
+	copy(out, u)
+	for n := 1; n < iter; n++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for i := range out {
+			out[i] ^= u[i]
+		}
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package hbot
+
+import "testing"
+
+// The SCRAM-SHA-256 exchange from RFC 7677, section 3
+func TestScramSHA256(t *testing.T) {
+	s := SASLScramSHA256("user", "pencil").(*saslScram)
+	if _, err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+	s.clientFirstBare = "n=user,r=" + s.clientNonce
+
+	resp, err := s.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(resp) != want {
+		t.Fatalf("client final = %q, want %q", resp, want)
+	}
+
+	if _, err := s.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("valid server signature rejected: %v", err)
+	}
+}
+
+func TestScramBadServer(t *testing.T) {
+	s := SASLScramSHA256("user", "pencil").(*saslScram)
+	s.Start()
+	if _, err := s.Next([]byte("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("foreign server nonce accepted")
+	}
+
+	s.Start()
+	s.clientNonce = "abc"
+	s.clientFirstBare = "n=user,r=abc"
+	if _, err := s.Next([]byte("r=abcdef,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("wrong server signature accepted")
+	}
+}
@@ -0,0 +1,83 @@
+package hbot
+
+import (
+	"errors"
+	"testing"
+)
+
+// startSASL negotiates the sasl capability and returns what the bot sent
+func startSASL(bot *Bot, mechs string) []string {
+	bot.sasl.SetAuth("hbot", "secret")
+	feed(bot,
+		":irc.example.org CAP * LS :sasl="+mechs,
+		":irc.example.org CAP hbot ACK :sasl",
+	)
+	return sent(bot)
+}
+
+func TestSASLFailureContinue(t *testing.T) {
+	bot := newTestBot(t)
+	startSASL(bot, "PLAIN")
+	feed(bot, ":irc.example.org 904 hbot :SASL authentication failed")
+	if lines := sent(bot); count(lines, "CAP END") != 1 {
+		t.Errorf("sent %q, want CAP END", lines)
+	}
+	if err := bot.aborted(); err != nil {
+		t.Errorf("aborted with %v", err)
+	}
+}
+
+func TestSASLFailureAbort(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.SASLFailure = SASLAbort })
+	startSASL(bot, "PLAIN")
+	feed(bot, ":irc.example.org 904 hbot :SASL authentication failed")
+	if lines := sent(bot); count(lines, "CAP END") != 0 {
+		t.Errorf("registration continued after SASL failed")
+	}
+	var serr *SASLError
+	if err := bot.aborted(); !errors.As(err, &serr) {
+		t.Fatalf("aborted with %v, want a *SASLError", err)
+	}
+	if serr.Numeric != "904" || serr.Mechanism != "PLAIN" {
+		t.Errorf("aborted with %+v", *serr)
+	}
+}
+
+func TestSASLFailureRetry(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) {
+		b.SASLFailure = SASLRetry
+		b.SASLMechanisms = []SASLMechanism{SASLExternal(), SASLScramSHA256("hbot", "secret"), SASLPlain("hbot", "secret")}
+	})
+	// SCRAM-SHA-256 is skipped, the server doesn't offer it
+	if lines := startSASL(bot, "PLAIN,EXTERNAL"); count(lines, "AUTHENTICATE EXTERNAL") != 1 {
+		t.Fatalf("sent %q, want AUTHENTICATE EXTERNAL", lines)
+	}
+	feed(bot, ":irc.example.org 904 hbot :SASL authentication failed")
+	if lines := sent(bot); count(lines, "AUTHENTICATE PLAIN") != 1 {
+		t.Fatalf("sent %q, want AUTHENTICATE PLAIN", lines)
+	}
+	if err := bot.aborted(); err != nil {
+		t.Fatalf("aborted with %v while a mechanism was left", err)
+	}
+	feed(bot, ":irc.example.org 904 hbot :SASL authentication failed")
+	var serr *SASLError
+	if err := bot.aborted(); !errors.As(err, &serr) {
+		t.Fatalf("aborted with %v, want a *SASLError", err)
+	}
+	if serr.Mechanism != "PLAIN" {
+		t.Errorf("aborted with %+v, want PLAIN to have failed last", *serr)
+	}
+}
+
+func TestSASLUnavailable(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.SASLFailure = SASLAbort })
+	bot.sasl.SetAuth("hbot", "secret")
+	feed(bot, ":irc.example.org CAP * LS :server-time")
+	var serr *SASLError
+	if err := bot.aborted(); !errors.As(err, &serr) {
+		t.Fatalf("aborted with %v, want a *SASLError", err)
+	}
+	if serr.Numeric != "" {
+		t.Errorf("aborted with %+v, want no numeric", *serr)
+	}
+}
@@ -0,0 +1,155 @@
+package hbot
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Formatting codes that take arguments, which must not be split
+// ref: https://modern.ircdocs.horse/formatting.html
+const (
+	formatColor    = '\x03'
+	formatHexColor = '\x04'
+)
+
+// splitText splits text into lines of at most size bytes. It breaks at
+// newlines, otherwise preferably between words, and never inside a UTF-8
+// character or a color code. marker is appended to every line that is
+// continued on the next one.
+func splitText(text string, size int, marker string) []string {
+	if text == "" {
+		return nil
+	}
+	// Always make some progress, however silly the size
+	if size-len(marker) < utf8.UTFMax {
+		size = utf8.UTFMax + len(marker)
+	}
+
+	var ret []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		for len(line) > size {
+			cut, next := splitPoint(line, size-len(marker))
+			ret = append(ret, line[:cut]+marker)
+			line = line[next:]
+		}
+		ret = append(ret, line)
+	}
+	// Like the scanner we used to split with, ignore a final newline
+	if len(ret) > 1 && ret[len(ret)-1] == "" {
+		ret = ret[:len(ret)-1]
+	}
+	return ret
+}
+
+// splitConcat splits a single line into pieces of at most size bytes that
+// give back the line when concatenated, keeping the spaces it breaks at
+func splitConcat(line string, size int) []string {
+	if size < utf8.UTFMax {
+		size = utf8.UTFMax
+	}
+	var ret []string
+	for len(line) > size {
+		cut, next := splitPoint(line, size)
+		if next > cut && next <= size {
+			cut = next
+		}
+		ret = append(ret, line[:cut])
+		line = line[cut:]
+	}
+	return append(ret, line)
+}
+
+// splitPoint returns where to end a line that is longer than max bytes, and
+// where the next line starts
+func splitPoint(line string, max int) (cut, next int) {
+	cut = max
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	cut = beforeFormatting(line, cut)
+	if cut == 0 {
+		// A color code longer than the line, there is no good choice
+		cut = max
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+	}
+	if cut == 0 {
+		// Not UTF-8 at all, cut where we must
+		cut = max
+	}
+
+	// Prefer to break at a space, unless that leaves a very short line
+	if i := strings.LastIndexByte(line[:cut+1], ' '); i > cut/2 {
+		return i, i + 1
+	}
+	return cut, cut
+}
+
+// beforeFormatting moves cut before a color code it would fall into
+func beforeFormatting(line string, cut int) int {
+	// The longest code is \x04RRGGBB,RRGGBB
+	start := cut - 13
+	if start < 0 {
+		start = 0
+	}
+	for i := cut - 1; i >= start; i-- {
+		switch line[i] {
+		case formatColor:
+			if i+colorCodeLen(line[i:], isDigit, 2) > cut {
+				return i
+			}
+			return cut
+		case formatHexColor:
+			if i+colorCodeLen(line[i:], isHexDigit, 6) > cut {
+				return i
+			}
+			return cut
+		}
+	}
+	return cut
+}
+
+// colorCodeLen returns the length of the color code at the start of s, which
+// is a control character followed by an optional foreground and background
+func colorCodeLen(s string, valid func(byte) bool, digits int) int {
+	n := 1
+	count := func() int {
+		i := 0
+		for i < digits && n+i < len(s) && valid(s[n+i]) {
+			i++
+		}
+		return i
+	}
+	fg := count()
+	n += fg
+	if fg > 0 && n+1 < len(s) && s[n] == ',' && valid(s[n+1]) {
+		n++
+		n += count()
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// maxPayload returns how many bytes of text fit in a single command to
+// target. The server prepends our full hostmask when relaying the line, and
+// all of it must fit in the server's line length.
+func (bot *Bot) maxPayload(command, target string) int {
+	is := bot.ISupport()
+	prefix := bot.Hostmask()
+	if !strings.Contains(prefix, "@") {
+		// We don't know our user@host yet, assume the longest possible
+		prefix += "!~" + strings.Repeat("x", is.UserLen()) + "@" + strings.Repeat("x", is.HostLen())
+	}
+	// :prefix COMMAND target :text\r\n
+	overhead := 1 + len(prefix) + 1 + len(command) + 1 + len(target) + 2 + 2
+	return is.LineLen() - overhead
+}
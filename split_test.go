@@ -0,0 +1,68 @@
+package hbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		size   int
+		marker string
+		want   []string
+	}{
+		{"empty", "", 10, "", nil},
+		{"short", "hello", 10, "", []string{"hello"}},
+		{"newlines", "a\r\nb\nc\n", 10, "", []string{"a", "b", "c"}},
+		{"words", "hello there world", 11, "", []string{"hello there", "world"}},
+		{"marker", "hello there world", 11, "…", []string{"hello…", "there world"}},
+		{"no space", "abcdefghij", 6, "", []string{"abcdef", "ghij"}},
+		{"utf8", "ééééé", 5, "", []string{"éé", "éé", "é"}},
+		{"color", "abcdef\x0312,04red", 9, "", []string{"abcdef", "\x0312,04red"}},
+		{"hex color", "abc\x04FF0000x", 8, "", []string{"abc", "\x04FF0000x"}},
+		{"invalid utf8", strings.Repeat("\x80", 12), 5, "", []string{"\x80\x80\x80\x80\x80", "\x80\x80\x80\x80\x80", "\x80\x80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitText(tt.text, tt.size, tt.marker)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitText(%q, %d, %q) = %q, want %q", tt.text, tt.size, tt.marker, got, tt.want)
+			}
+			for _, line := range got {
+				if len(line) > tt.size && len(line) > utf8.UTFMax+len(tt.marker) {
+					t.Errorf("line %q longer than %d", line, tt.size)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitConcat(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		size int
+		want []string
+	}{
+		{"short", "hello", 10, []string{"hello"}},
+		{"keeps spaces", "hello there world", 8, []string{"hello ", "there ", "world"}},
+		{"utf8", "ééééé", 5, []string{"éé", "éé", "é"}},
+		{"color", "abcdef\x0312,04red", 9, []string{"abcdef", "\x0312,04red"}},
+		{"invalid utf8", strings.Repeat("\x80", 12), 5, []string{"\x80\x80\x80\x80\x80", "\x80\x80\x80\x80\x80", "\x80\x80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitConcat(tt.line, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitConcat(%q, %d) = %q, want %q", tt.line, tt.size, got, tt.want)
+			}
+			if joined := strings.Join(got, ""); joined != tt.line {
+				t.Errorf("pieces join to %q, want %q", joined, tt.line)
+			}
+		})
+	}
+}
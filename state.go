@@ -0,0 +1,391 @@
+package hbot
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// State keeps track of the channels the bot is in, their members and
+// topics, and of the users in them. It is only maintained if the bot's
+// TrackState is set, and is updated before any trigger sees the message
+// that changed it.
+type State struct {
+	bot *Bot
+	mu  sync.RWMutex
+	// Channels we are in, by folded name
+	channels map[string]*channelState
+	// Users sharing a channel with us, by folded nick
+	users map[string]*User
+}
+
+type channelState struct {
+	name string
+	// Members by folded nick
+	members map[string]*Member
+	// Members listed by a NAMES reply in progress
+	names        map[string]*Member
+	topic        string
+	topicSetBy   string
+	topicSetTime time.Time
+	// Set once we asked WHO about the channel's members
+	whoSent bool
+}
+
+// Member is a user in a channel
+type Member struct {
+	Nick string
+	// Prefix modes the member has in the channel, such as "o" or "v",
+	// highest first
+	Modes string
+}
+
+func newState(bot *Bot) *State {
+	return &State{
+		bot:      bot,
+		channels: make(map[string]*channelState),
+		users:    make(map[string]*User),
+	}
+}
+
+// reset forgets everything, for a new connection
+func (s *State) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = make(map[string]*channelState)
+	s.users = make(map[string]*User)
+}
+
+func (s *State) Handle(bot *Bot, m *Message) bool {
+	is := bot.ISupport()
+	var nick string
+	if m.Prefix != nil {
+		nick = m.Prefix.Name
+	}
+	switch m.Command {
+	case "JOIN", "PART", "QUIT", "NICK":
+		// Without a sender there is nobody to update
+		if nick == "" {
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	send := s.update(bot, is, nick, m)
+	s.mu.Unlock()
+	// Sending can block, don't hold up readers of the state meanwhile
+	for _, line := range send {
+		bot.Send(line)
+	}
+	return false
+}
+
+// update applies m with s.mu held, and returns the commands to send once it
+// is released
+func (s *State) update(bot *Bot, is *ISupport, nick string, m *Message) []string {
+	isUs := func(name string) bool {
+		return is.EqualFold(name, bot.CurrentNick())
+	}
+
+	switch m.Command {
+	case "JOIN":
+		name := m.Param(0)
+		if isUs(nick) {
+			s.channels[is.Fold(name)] = &channelState{name: name, members: make(map[string]*Member)}
+		}
+		if ch := s.channels[is.Fold(name)]; ch != nil {
+			ch.members[is.Fold(nick)] = &Member{Nick: nick}
+		}
+
+	case "PART":
+		for _, name := range strings.Split(m.Param(0), ",") {
+			s.leave(is, name, nick, isUs(nick))
+		}
+
+	case "KICK":
+		s.leave(is, m.Param(0), m.Param(1), isUs(m.Param(1)))
+
+	case "QUIT":
+		for _, ch := range s.channels {
+			delete(ch.members, is.Fold(nick))
+		}
+
+	case "NICK":
+		newNick := m.Param(0)
+		for _, ch := range s.channels {
+			if mb := ch.members[is.Fold(nick)]; mb != nil {
+				delete(ch.members, is.Fold(nick))
+				mb.Nick = newNick
+				ch.members[is.Fold(newNick)] = mb
+			}
+		}
+
+	case irc.RPL_NAMREPLY:
+		// <client> <symbol> <channel> :[prefix]<nick>{ [prefix]<nick>}
+		ch := s.channels[is.Fold(m.Param(2))]
+		if ch == nil {
+			return nil
+		}
+		if ch.names == nil {
+			ch.names = make(map[string]*Member)
+		}
+		modes, prefixes := is.Prefix()
+		for _, entry := range strings.Fields(m.Trailing()) {
+			mb := &Member{}
+			for entry != "" {
+				i := strings.IndexByte(prefixes, entry[0])
+				if i < 0 {
+					break
+				}
+				mb.Modes += modes[i : i+1]
+				entry = entry[1:]
+			}
+			// userhost-in-names sends nick!user@host
+			mb.Nick = irc.ParsePrefix(entry).Name
+			if mb.Nick != "" {
+				ch.members[is.Fold(mb.Nick)] = mb
+				ch.names[is.Fold(mb.Nick)] = mb
+			}
+		}
+
+	case irc.RPL_ENDOFNAMES:
+		// The reply is complete, so anyone not listed left unnoticed
+		if ch := s.channels[is.Fold(m.Param(1))]; ch != nil && ch.names != nil {
+			ch.members = ch.names
+			ch.names = nil
+		}
+
+	case irc.RPL_TOPIC:
+		if ch := s.channels[is.Fold(m.Param(1))]; ch != nil {
+			ch.topic = m.Trailing()
+		}
+
+	// 333 RPL_TOPICWHOTIME
+	case "333":
+		if ch := s.channels[is.Fold(m.Param(1))]; ch != nil {
+			ch.topicSetBy = irc.ParsePrefix(m.Param(2)).Name
+			ch.topicSetTime = parseUnixTime(m.Param(3))
+		}
+
+	case irc.RPL_NOTOPIC:
+		if ch := s.channels[is.Fold(m.Param(1))]; ch != nil {
+			ch.topic, ch.topicSetBy, ch.topicSetTime = "", "", time.Time{}
+		}
+
+	case "TOPIC":
+		if ch := s.channels[is.Fold(m.Param(0))]; ch != nil {
+			ch.topic = m.Trailing()
+			ch.topicSetBy = nick
+			ch.topicSetTime = m.TimeStamp
+		}
+
+	case "MODE":
+		if ch := s.channels[is.Fold(m.Param(0))]; ch != nil && len(m.Params) > 1 {
+			s.applyModes(is, ch, m.Params[1], m.Params[2:])
+		}
+	}
+	return s.handleUser(is, nick, m)
+}
+
+// leave removes nick from a channel, or the whole channel if it is us
+func (s *State) leave(is *ISupport, channel, nick string, us bool) {
+	if us {
+		delete(s.channels, is.Fold(channel))
+		return
+	}
+	if ch := s.channels[is.Fold(channel)]; ch != nil {
+		delete(ch.members, is.Fold(nick))
+	}
+}
+
+// applyModes follows the prefix modes set by a channel MODE change, and
+// skips the parameters of all other modes
+func (s *State) applyModes(is *ISupport, ch *channelState, change string, args []string) {
+	prefixModes, _ := is.Prefix()
+	lists, always, onSet, _ := is.ChanModes()
+	adding := true
+	for _, mode := range change {
+		switch {
+		case mode == '+' || mode == '-':
+			adding = mode == '+'
+			continue
+		case strings.ContainsRune(prefixModes, mode):
+		case strings.ContainsRune(lists, mode) || strings.ContainsRune(always, mode):
+			if len(args) > 0 {
+				args = args[1:]
+			}
+			continue
+		case strings.ContainsRune(onSet, mode):
+			if adding && len(args) > 0 {
+				args = args[1:]
+			}
+			continue
+		default:
+			continue
+		}
+
+		if len(args) == 0 {
+			return
+		}
+		mb := ch.members[is.Fold(args[0])]
+		args = args[1:]
+		if mb == nil {
+			continue
+		}
+		// Keep the member's modes in PREFIX order
+		var modes strings.Builder
+		for _, pm := range prefixModes {
+			has := strings.ContainsRune(mb.Modes, pm)
+			if pm == mode {
+				has = adding
+			}
+			if has {
+				modes.WriteRune(pm)
+			}
+		}
+		mb.Modes = modes.String()
+	}
+}
+
+// parseUnixTime parses a timestamp in seconds, as sent by the server
+func parseUnixTime(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// Channels returns the names of the channels the bot is in
+func (s *State) Channels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.channels))
+	for _, ch := range s.channels {
+		names = append(names, ch.name)
+	}
+	return names
+}
+
+// Channel returns the given channel, or nil if the bot is not in it. The
+// methods of a nil *Channel return zero values.
+func (s *State) Channel(name string) *Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := s.bot.ISupport().Fold(name)
+	if _, ok := s.channels[key]; !ok {
+		return nil
+	}
+	return &Channel{state: s, key: key}
+}
+
+// CommonChannels returns the channels that both the bot and nick are in
+func (s *State) CommonChannels(nick string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := s.bot.ISupport().Fold(nick)
+	var names []string
+	for _, ch := range s.channels {
+		if _, ok := ch.members[key]; ok {
+			names = append(names, ch.name)
+		}
+	}
+	return names
+}
+
+// Channel is a channel the bot is in. Its methods return the current state,
+// or zero values once the bot left the channel.
+type Channel struct {
+	state *State
+	key   string
+}
+
+// with calls fn with the channel's state under the read lock
+func (c *Channel) with(fn func(ch *channelState)) {
+	if c == nil {
+		return
+	}
+	c.state.mu.RLock()
+	defer c.state.mu.RUnlock()
+	if ch := c.state.channels[c.key]; ch != nil {
+		fn(ch)
+	}
+}
+
+// Name returns the name of the channel, as we joined it
+func (c *Channel) Name() (name string) {
+	c.with(func(ch *channelState) {
+		name = ch.name
+	})
+	return name
+}
+
+// Topic returns the channel's topic, who set it and when, if known
+func (c *Channel) Topic() (topic, setBy string, setAt time.Time) {
+	c.with(func(ch *channelState) {
+		topic, setBy, setAt = ch.topic, ch.topicSetBy, ch.topicSetTime
+	})
+	return topic, setBy, setAt
+}
+
+// Members returns the users in the channel
+func (c *Channel) Members() []Member {
+	var members []Member
+	c.with(func(ch *channelState) {
+		members = make([]Member, 0, len(ch.members))
+		for _, mb := range ch.members {
+			members = append(members, *mb)
+		}
+	})
+	return members
+}
+
+// Member returns the given user, the boolean is false if they are not in
+// the channel
+func (c *Channel) Member(nick string) (member Member, ok bool) {
+	if c == nil {
+		return member, false
+	}
+	key := c.state.bot.ISupport().Fold(nick)
+	c.with(func(ch *channelState) {
+		var mb *Member
+		if mb, ok = ch.members[key]; ok {
+			member = *mb
+		}
+	})
+	return member, ok
+}
+
+// HasMode reports whether nick has the given prefix mode in the channel
+func (c *Channel) HasMode(nick string, mode byte) bool {
+	mb, _ := c.Member(nick)
+	return strings.IndexByte(mb.Modes, mode) >= 0
+}
+
+// IsOp reports whether nick is a channel operator, or has a higher prefix
+// mode such as founder
+func (c *Channel) IsOp(nick string) bool {
+	mb, _ := c.Member(nick)
+	if mb.Modes == "" {
+		return false
+	}
+	// Member returned a mode, so c is not nil
+	modes, _ := c.state.bot.ISupport().Prefix()
+	op := strings.IndexByte(modes, 'o')
+	highest := strings.IndexByte(modes, mb.Modes[0])
+	return highest >= 0 && highest <= op
+}
+
+// IsVoice reports whether nick has voice in the channel
+func (c *Channel) IsVoice(nick string) bool {
+	return c.HasMode(nick, 'v')
+}
+
+// State returns what the bot knows about the channels it is in. It stays
+// empty unless TrackState is set.
+func (bot *Bot) State() *State {
+	return bot.state
+}
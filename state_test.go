@@ -0,0 +1,214 @@
+package hbot
+
+import "testing"
+
+func TestStateIgnoresMessagesWithoutSender(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.TrackState = true })
+	feed(bot, ":hbot!bot@host JOIN #chan")
+	for _, line := range []string{"JOIN #chan", "PART #chan", "NICK :someone", "QUIT :gone"} {
+		feed(bot, line)
+		members := bot.State().Channel("#chan").Members()
+		if len(members) != 1 || members[0].Nick != "hbot" {
+			t.Errorf("after %q: members = %+v, want only hbot", line, members)
+		}
+		for _, u := range bot.State().Users() {
+			if u.Nick == "" {
+				t.Errorf("after %q: user without a nick in the registry", line)
+			}
+		}
+	}
+}
+
+// joinedBot returns a bot tracking state that is in #chan with the given
+// NAMES reply
+func joinedBot(t *testing.T, names string) *Bot {
+	t.Helper()
+	bot := newTestBot(t, func(b *Bot) { b.TrackState = true })
+	feed(bot,
+		":irc.example.org 001 hbot :Welcome",
+		":irc.example.org 005 hbot PREFIX=(qaohv)~&@%+ CHANMODES=beI,k,l,imnt :are supported by this server",
+		":hbot!bot@host JOIN #chan",
+		":irc.example.org 353 hbot = #chan :"+names,
+		":irc.example.org 366 hbot #chan :End of /NAMES list.",
+	)
+	sent(bot)
+	return bot
+}
+
+func memberModes(t *testing.T, bot *Bot, channel, nick string) string {
+	t.Helper()
+	mb, ok := bot.State().Channel(channel).Member(nick)
+	if !ok {
+		t.Fatalf("%s is not in %s", nick, channel)
+	}
+	return mb.Modes
+}
+
+func TestStateNamesMultiPrefix(t *testing.T) {
+	bot := joinedBot(t, "hbot @+alice %bob ~&carol dave!d@dave.host")
+	want := map[string]string{"hbot": "", "alice": "ov", "bob": "h", "carol": "qa", "dave": ""}
+	for nick, modes := range want {
+		if got := memberModes(t, bot, "#chan", nick); got != modes {
+			t.Errorf("%s has modes %q, want %q", nick, got, modes)
+		}
+	}
+	if u, _ := bot.State().User("dave"); u.Host != "dave.host" {
+		t.Errorf("userhost-in-names host = %q, want dave.host", u.Host)
+	}
+
+	// A new NAMES reply drops whoever left unnoticed
+	feed(bot,
+		":irc.example.org 353 hbot = #chan :hbot @alice",
+		":irc.example.org 366 hbot #chan :End of /NAMES list.",
+	)
+	if n := len(bot.State().Channel("#chan").Members()); n != 2 {
+		t.Errorf("%d members after the second NAMES, want 2", n)
+	}
+	if _, ok := bot.State().User("bob"); ok {
+		t.Error("bob is still known after leaving unnoticed")
+	}
+}
+
+func TestStateModes(t *testing.T) {
+	bot := joinedBot(t, "hbot @alice bob")
+	// Parameters of k, l and b are skipped
+	feed(bot, ":alice!a@host MODE #chan +kob-l+v-o+b key bob *!*@spam bob alice *!*@bad")
+	ch := bot.State().Channel("#chan")
+	if !ch.IsOp("bob") || !ch.IsVoice("bob") {
+		t.Errorf("bob has modes %q, want ov", memberModes(t, bot, "#chan", "bob"))
+	}
+	if ch.IsOp("alice") {
+		t.Errorf("alice is still op")
+	}
+	feed(bot, ":alice!a@host MODE #chan +ha bob bob")
+	if got := memberModes(t, bot, "#chan", "bob"); got != "aohv" {
+		t.Errorf("bob has modes %q, want them in PREFIX order aohv", got)
+	}
+}
+
+func TestStateKick(t *testing.T) {
+	bot := joinedBot(t, "hbot @alice bob")
+	feed(bot, ":alice!a@host KICK #chan bob :bye")
+	if _, ok := bot.State().Channel("#chan").Member("bob"); ok {
+		t.Error("bob is still a member after the kick")
+	}
+	if _, ok := bot.State().User("bob"); ok {
+		t.Error("bob is still known after the kick")
+	}
+	feed(bot, ":alice!a@host KICK #chan hbot :you too")
+	if bot.State().Channel("#chan") != nil {
+		t.Error("still tracking #chan after we were kicked")
+	}
+	if len(bot.State().Users()) != 0 {
+		t.Errorf("users = %+v, want none", bot.State().Users())
+	}
+}
+
+func TestStateWHOX(t *testing.T) {
+	bot := newTestBot(t, func(b *Bot) { b.TrackState = true })
+	feed(bot,
+		":irc.example.org 001 hbot :Welcome",
+		":irc.example.org 005 hbot WHOX :are supported by this server",
+		":hbot!bot@host JOIN #chan",
+		":irc.example.org 353 hbot = #chan :hbot alice",
+		":irc.example.org 366 hbot #chan :End of /NAMES list.",
+	)
+	if lines := sent(bot); count(lines, "WHO #chan %tnuhraf,"+whoxToken) != 1 {
+		t.Fatalf("sent %q, want a WHOX query", lines)
+	}
+	feed(bot,
+		":irc.example.org 354 hbot "+whoxToken+" ali alice.host alice G alice_acct :Alice A.",
+		":irc.example.org 354 hbot 999 x x.host alice H other :Someone else's query",
+	)
+	u, ok := bot.State().User("alice")
+	if !ok {
+		t.Fatal("alice is not known")
+	}
+	want := User{Nick: "alice", Ident: "ali", Host: "alice.host", Account: "alice_acct", Realname: "Alice A.", Away: true}
+	if u != want {
+		t.Errorf("alice = %+v, want %+v", u, want)
+	}
+	// Asked once per channel
+	feed(bot,
+		":irc.example.org 353 hbot = #chan :hbot alice",
+		":irc.example.org 366 hbot #chan :End of /NAMES list.",
+	)
+	if lines := sent(bot); len(lines) != 0 {
+		t.Errorf("sent %q after a second NAMES reply", lines)
+	}
+}
+
+func TestStateEviction(t *testing.T) {
+	bot := joinedBot(t, "hbot alice")
+	feed(bot,
+		":hbot!bot@host JOIN #other",
+		":irc.example.org 353 hbot = #other :hbot alice",
+		":irc.example.org 366 hbot #other :End of /NAMES list.",
+		":alice!a@host PART #chan",
+	)
+	if _, ok := bot.State().User("alice"); !ok {
+		t.Fatal("alice was forgotten while still sharing #other")
+	}
+	if got := bot.State().CommonChannels("alice"); len(got) != 1 || got[0] != "#other" {
+		t.Errorf("common channels = %q, want #other", got)
+	}
+	feed(bot, ":hbot!bot@host PART #other")
+	if _, ok := bot.State().User("alice"); ok {
+		t.Error("alice is still known after we left the last shared channel")
+	}
+}
+
+func TestUserAccountNotify(t *testing.T) {
+	bot := joinedBot(t, "hbot")
+	feed(bot, ":alice!a@host JOIN #chan alice_acct :Alice A.")
+	u, _ := bot.State().User("alice")
+	if u.Account != "alice_acct" || u.Realname != "Alice A." || u.Host != "host" {
+		t.Errorf("after extended-join alice = %+v", u)
+	}
+	feed(bot, ":alice!a@host ACCOUNT *")
+	if u, _ := bot.State().User("alice"); u.Account != "" {
+		t.Errorf("account after logging out = %q, want none", u.Account)
+	}
+	feed(bot, ":alice!a@host ACCOUNT other_acct")
+	if u, _ := bot.State().User("alice"); u.Account != "other_acct" {
+		t.Errorf("account = %q, want other_acct", u.Account)
+	}
+}
+
+func TestUserAwayNotify(t *testing.T) {
+	bot := joinedBot(t, "hbot alice")
+	feed(bot, ":alice!a@host AWAY :gone fishing")
+	if u, _ := bot.State().User("alice"); !u.Away || u.AwayMessage != "gone fishing" {
+		t.Errorf("alice = %+v, want away fishing", u)
+	}
+	feed(bot, ":alice!a@host AWAY")
+	if u, _ := bot.State().User("alice"); u.Away || u.AwayMessage != "" {
+		t.Errorf("alice = %+v, want back", u)
+	}
+	feed(bot, ":irc.example.org 301 hbot alice :lunch")
+	if u, _ := bot.State().User("alice"); !u.Away || u.AwayMessage != "lunch" {
+		t.Errorf("alice = %+v, want away from RPL_AWAY", u)
+	}
+}
+
+func TestUserLeavesLastChannel(t *testing.T) {
+	bot := joinedBot(t, "hbot alice bob")
+	feed(bot, ":alice!a@host NICK alice2")
+	if _, ok := bot.State().User("alice"); ok {
+		t.Error("old nick still known after NICK")
+	}
+	if _, ok := bot.State().User("alice2"); !ok {
+		t.Error("new nick not known after NICK")
+	}
+	feed(bot, ":alice2!a@host PART #chan :bye")
+	if _, ok := bot.State().User("alice2"); ok {
+		t.Error("alice2 still known after leaving the only shared channel")
+	}
+	feed(bot, ":bob!b@host QUIT :bye")
+	if _, ok := bot.State().User("bob"); ok {
+		t.Error("bob still known after quitting")
+	}
+	if users := bot.State().Users(); len(users) != 1 || users[0].Nick != "hbot" {
+		t.Errorf("users = %+v, want only hbot", users)
+	}
+}
@@ -0,0 +1,107 @@
+package hbot
+
+import (
+	"sync"
+	"time"
+)
+
+// Typing states for the "+typing" client tag
+// ref: https://ircv3.net/specs/client-tags/typing
+const (
+	TypingActive = "active"
+	TypingPaused = "paused"
+	TypingDone   = "done"
+)
+
+// How often an active typing notification is repeated. Clients forget it
+// after 6 seconds.
+const typingInterval = 3 * time.Second
+
+// TagMsg sends a TAGMSG, a message without text that only carries tags, to
+// 'who' (user or channel). Nothing is sent if the server does not support
+// message-tags.
+func (bot *Bot) TagMsg(who string, tags Tags) {
+	if !bot.HasCap("message-tags") {
+		bot.Debug("Not sending TAGMSG, server lacks message-tags", "target", who, "tags", tags.String())
+		return
+	}
+	bot.sendTagged(tags, "TAGMSG "+who)
+}
+
+// Typing tells 'who' that the bot is typing (TypingActive), stopped for a
+// moment (TypingPaused) or gave up (TypingDone)
+func (bot *Bot) Typing(who, state string) {
+	bot.TagMsg(who, Tags{"+typing": state})
+}
+
+// StartTyping shows 'who' that the bot is typing until the returned function
+// is called, for actions that take a while:
+//
+//	defer bot.StartTyping(bot.ReplyTarget(m))()
+func (bot *Bot) StartTyping(who string) (stop func()) {
+	if !bot.HasCap("message-tags") {
+		return func() {}
+	}
+	done := make(chan struct{})
+	bot.Typing(who, TypingActive)
+	go func() {
+		tick := time.NewTicker(typingInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				bot.Typing(who, TypingActive)
+			case <-done:
+				bot.Typing(who, TypingDone)
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Typing returns the "+typing" state a TAGMSG carries, if any
+func (m *Message) Typing() string {
+	return m.Tags["+typing"]
+}
+
+// TagMsgHandler receives incoming TAGMSG messages, such as reactions and
+// typing notifications. They are passed to the bot's triggers as well.
+type TagMsgHandler interface {
+	HandleTagMsg(*Bot, *Message)
+}
+
+// TagMsgHandlerFunc makes a function a TagMsgHandler
+type TagMsgHandlerFunc func(*Bot, *Message)
+
+// HandleTagMsg calls f(bot, m)
+func (f TagMsgHandlerFunc) HandleTagMsg(bot *Bot, m *Message) {
+	f(bot, m)
+}
+
+// AddTagMsgHandler adds a handler for incoming TAGMSG messages
+func (bot *Bot) AddTagMsgHandler(h TagMsgHandler) {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	bot.tagMsgHandlers = append(bot.tagMsgHandlers, h)
+}
+
+func (bot *Bot) dispatchTagMsg(m *Message) {
+	bot.triggersMu.RLock()
+	handlers := bot.tagMsgHandlers
+	bot.triggersMu.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+	bot.dispatcher.submit(bot.dispatchKey(m), func() {
+		for _, h := range handlers {
+			func() {
+				defer bot.recoverHandler("TAGMSG")
+				h.HandleTagMsg(bot, m)
+			}()
+		}
+	}, bot.connContext().Done())
+}
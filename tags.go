@@ -0,0 +1,208 @@
+package hbot
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maximum length of the client-only tags we may send, including the
+// leading '@' and trailing space
+const maxClientTagsLen = 4094
+
+// Tags are the IRCv3 message tags of a message, with their values
+// unescaped. A tag without a value maps to the empty string.
+// ref: https://ircv3.net/specs/extensions/message-tags
+type Tags map[string]string
+
+// Get returns the value of a tag and whether the message has it
+func (t Tags) Get(name string) (string, bool) {
+	value, ok := t[name]
+	return value, ok
+}
+
+// String returns the tags as sent on the wire, without the leading '@'
+func (t Tags) String() string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(name)
+		if value := t[name]; value != "" {
+			b.WriteByte('=')
+			b.WriteString(tagEscaper.Replace(value))
+		}
+	}
+	return b.String()
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// parseTags parses the tags of a message, without the leading '@'
+func parseTags(raw string) Tags {
+	tags := make(Tags)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		name, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			name, value = tag[:i], unescapeTag(tag[i+1:])
+		}
+		// The last occurrence of a tag wins
+		tags[name] = value
+	}
+	return tags
+}
+
+func unescapeTag(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		// A lone trailing backslash is dropped
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// Tag returns the value of one of the message's tags
+func (m *Message) Tag(name string) (string, bool) {
+	return m.Tags.Get(name)
+}
+
+// ServerTime returns the time the server says the message was sent at, from
+// the server-time "time" tag. The boolean is false if there is none.
+func (m *Message) ServerTime() (time.Time, bool) {
+	value, ok := m.Tags.Get("time")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// MsgID returns the server assigned ID of the message, if any
+func (m *Message) MsgID() string {
+	return m.Tags["msgid"]
+}
+
+// Account returns the account the sender is logged in to, from the
+// account-tag capability. It is empty if they are not logged in or the
+// server does not tell.
+func (m *Message) Account() string {
+	return m.Tags["account"]
+}
+
+// ReplyTo returns the msgid of the message this one replies to, from the
+// "+draft/reply" client tag
+func (m *Message) ReplyTo() string {
+	return m.Tags["+draft/reply"]
+}
+
+// Reaction returns the reaction, such as an emoji, this message carries in
+// the "+draft/react" client tag. Reactions usually come as a TAGMSG, with
+// ReplyTo telling which message they react to.
+func (m *Message) Reaction() string {
+	return m.Tags["+draft/react"]
+}
+
+// ClientTags returns the client-only tags of the message, those starting
+// with '+'
+func (m *Message) ClientTags() Tags {
+	tags := make(Tags)
+	for name, value := range m.Tags {
+		if strings.HasPrefix(name, "+") {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// sendTagged sends a command with tags. Tags are left out if the server
+// did not enable message-tags, as it would reject the line.
+func (bot *Bot) sendTagged(tags Tags, command string) {
+	if len(tags) == 0 || !bot.HasCap("message-tags") {
+		bot.Send(command)
+		return
+	}
+	raw := tags.String()
+	if len(raw)+2 > maxClientTagsLen {
+		bot.Warn("Tags too long, sending without them", "tags", raw)
+		bot.Send(command)
+		return
+	}
+	bot.Send("@" + raw + " " + command)
+}
+
+// MsgWithTags sends a message to 'who' (user or channel) with the given
+// tags, such as client-only "+" tags. The tags are only sent if the server
+// supports message-tags, and with every line if text has to be split.
+func (bot *Bot) MsgWithTags(who, text string, tags Tags) {
+	for _, line := range splitText(text, bot.maxPayload("PRIVMSG", who), bot.SplitMarker) {
+		bot.sendTagged(tags, "PRIVMSG "+who+" :"+line)
+	}
+}
+
+// ReplyTarget returns where to answer m: the channel it was sent to, or the
+// user who sent it privately
+func (bot *Bot) ReplyTarget(m *Message) string {
+	if bot.ISupport().IsChannel(m.To) {
+		return m.To
+	}
+	return m.From
+}
+
+// ReplyThreaded is like Reply, but marks the answer as a reply to m with the
+// "+draft/reply" tag so that clients can show what it answers
+func (bot *Bot) ReplyThreaded(m *Message, text string) {
+	target := bot.ReplyTarget(m)
+	msgid := m.MsgID()
+	if msgid == "" {
+		bot.Msg(target, text)
+		return
+	}
+	bot.MsgWithTags(target, text, Tags{"+draft/reply": msgid})
+}
+
+// React reacts to m with reaction, usually an emoji, using a TAGMSG with the
+// "+draft/react" tag. Nothing is sent if the server does not support
+// message-tags or m has no msgid.
+func (bot *Bot) React(m *Message, reaction string) {
+	msgid := m.MsgID()
+	if msgid == "" || !bot.HasCap("message-tags") {
+		bot.Debug("Can't react to message", "msgid", msgid, "reaction", reaction)
+		return
+	}
+	bot.TagMsg(bot.ReplyTarget(m), Tags{"+draft/reply": msgid, "+draft/react": reaction})
+}
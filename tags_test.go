@@ -0,0 +1,63 @@
+package hbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Tags
+	}{
+		{"", Tags{}},
+		{"a", Tags{"a": ""}},
+		{"a=1;b=2", Tags{"a": "1", "b": "2"}},
+		{"a=1;a=2", Tags{"a": "2"}},
+		{"+draft/reply=abc;msgid=x", Tags{"+draft/reply": "abc", "msgid": "x"}},
+		{`a=b\:c\sd\\e\rf\ng`, Tags{"a": "b;c d\\e\rf\ng"}},
+		{`a=\x`, Tags{"a": "x"}},
+		{`a=b\`, Tags{"a": "b"}},
+		{";;a=1;", Tags{"a": "1"}},
+	}
+	for _, tt := range tests {
+		if got := parseTags(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTags(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	tests := []Tags{
+		{},
+		{"a": ""},
+		{"a": "1", "b": "2"},
+		{"+draft/react": "👍", "+draft/reply": "msg1"},
+		{"a": "semi;colon space back\\slash\r\n"},
+	}
+	for _, tags := range tests {
+		raw := tags.String()
+		if strings.ContainsAny(raw, " \r\n") {
+			t.Errorf("%q: String() = %q is not escaped", tags, raw)
+		}
+		if got := parseTags(raw); !reflect.DeepEqual(got, tags) {
+			t.Errorf("parseTags(%q) = %q, want %q", raw, got, tags)
+		}
+	}
+	if got := (Tags{"b": "2", "a": "1"}).String(); got != "a=1;b=2" {
+		t.Errorf("String() = %q, want sorted a=1;b=2", got)
+	}
+}
+
+func TestParseMessageInvalid(t *testing.T) {
+	for _, raw := range []string{"", "@a=b", "@a=b ", " "} {
+		if m := ParseMessage(raw); m != nil {
+			t.Errorf("ParseMessage(%q) = %+v, want nil", raw, m)
+		}
+	}
+	m := ParseMessage("@a=b :alice!a@host PRIVMSG #chan :hi")
+	if m == nil || m.Command != "PRIVMSG" || m.Tags["a"] != "b" {
+		t.Errorf("ParseMessage of a tagged message = %+v", m)
+	}
+}
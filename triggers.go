@@ -0,0 +1,205 @@
+package hbot
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TriggerID identifies a trigger added with AddTrigger
+type TriggerID int
+
+// trigger is a handler added with AddTrigger
+type trigger struct {
+	id       TriggerID
+	name     string
+	priority int
+	timeout  time.Duration
+	handler  ContextHandler
+	// Applied inside the bot's own middleware
+	middleware []Middleware
+	// Built-in triggers run outside of the bot's middleware
+	builtin bool
+	// Guarded by bot.triggersMu
+	panics   []time.Time
+	disabled bool
+}
+
+func (t *trigger) String() string {
+	if t.name != "" {
+		return strconv.Quote(t.name)
+	}
+	return strconv.Itoa(int(t.id))
+}
+
+// TriggerOption configures a trigger passed to AddTrigger
+type TriggerOption func(*trigger)
+
+// TriggerName names a trigger, to find it again with TriggerByName and to
+// tell it apart in logs
+func TriggerName(name string) TriggerOption {
+	return func(t *trigger) {
+		t.name = name
+	}
+}
+
+// TriggerPriority sets the priority of a trigger. Triggers with a higher
+// priority see messages first, those with the same priority in the order
+// they were added. The default priority is 0.
+func TriggerPriority(priority int) TriggerOption {
+	return func(t *trigger) {
+		t.priority = priority
+	}
+}
+
+// AddTrigger adds a trigger to the bot's handlers. The returned ID is used
+// to remove, replace, disable or enable it later. Triggers can be added and
+// changed at any time, also while the bot is running.
+func (bot *Bot) AddTrigger(h Handler, options ...TriggerOption) TriggerID {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	bot.nextTrigger++
+	t := &trigger{id: bot.nextTrigger, handler: WithContext(h)}
+	for _, option := range options {
+		option(t)
+	}
+	bot.handlers = append(bot.handlers, t)
+	bot.sortTriggers()
+	return t.id
+}
+
+// sortTriggers orders the triggers by priority, with bot.triggersMu held
+func (bot *Bot) sortTriggers() {
+	sort.SliceStable(bot.handlers, func(i, j int) bool {
+		return bot.handlers[i].priority > bot.handlers[j].priority
+	})
+}
+
+// findTrigger returns the trigger with the given ID, with bot.triggersMu
+// held
+func (bot *Bot) findTrigger(id TriggerID) (int, *trigger) {
+	for i, t := range bot.handlers {
+		if t.id == id {
+			return i, t
+		}
+	}
+	return -1, nil
+}
+
+// triggers returns the triggers that are enabled, in order
+func (bot *Bot) triggers() []*trigger {
+	bot.triggersMu.RLock()
+	defer bot.triggersMu.RUnlock()
+	enabled := make([]*trigger, 0, len(bot.handlers))
+	for _, t := range bot.handlers {
+		if !t.disabled {
+			enabled = append(enabled, t)
+		}
+	}
+	return enabled
+}
+
+// TriggerByName returns the ID of the first trigger with the given name
+func (bot *Bot) TriggerByName(name string) (TriggerID, bool) {
+	bot.triggersMu.RLock()
+	defer bot.triggersMu.RUnlock()
+	for _, t := range bot.handlers {
+		if t.name == name {
+			return t.id, true
+		}
+	}
+	return 0, false
+}
+
+// RemoveTrigger removes a trigger. It returns false if there is no such
+// trigger. A message that is being handled may still reach it.
+func (bot *Bot) RemoveTrigger(id TriggerID) bool {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	i, t := bot.findTrigger(id)
+	if t == nil {
+		return false
+	}
+	bot.handlers = append(bot.handlers[:i:i], bot.handlers[i+1:]...)
+	return true
+}
+
+// ReplaceTrigger swaps the handler of a trigger, keeping its ID, name,
+// priority, timeout and the panics counted against it. It returns false if
+// there is no such trigger.
+func (bot *Bot) ReplaceTrigger(id TriggerID, h Handler) bool {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	i, t := bot.findTrigger(id)
+	if t == nil {
+		return false
+	}
+	// Dispatch may hold on to the old trigger, so don't change it
+	bot.handlers[i] = &trigger{
+		id:         t.id,
+		name:       t.name,
+		priority:   t.priority,
+		timeout:    t.timeout,
+		handler:    WithContext(h),
+		middleware: t.middleware,
+		builtin:    t.builtin,
+		panics:     append([]time.Time(nil), t.panics...),
+		disabled:   t.disabled,
+	}
+	return true
+}
+
+// SetTriggerPriority changes the priority of a trigger. It returns false if
+// there is no such trigger.
+func (bot *Bot) SetTriggerPriority(id TriggerID, priority int) bool {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	_, t := bot.findTrigger(id)
+	if t == nil {
+		return false
+	}
+	t.priority = priority
+	bot.sortTriggers()
+	return true
+}
+
+// EnableTrigger enables a trigger that was disabled with DisableTrigger or
+// for panicking. It returns false if there is no such trigger.
+func (bot *Bot) EnableTrigger(id TriggerID) bool {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	_, t := bot.findTrigger(id)
+	if t == nil {
+		return false
+	}
+	t.disabled = false
+	t.panics = nil
+	return true
+}
+
+// DisableTrigger stops a trigger from seeing messages until it is enabled
+// again. It returns false if there is no such trigger.
+func (bot *Bot) DisableTrigger(id TriggerID) bool {
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	_, t := bot.findTrigger(id)
+	if t == nil {
+		return false
+	}
+	t.disabled = true
+	return true
+}
+
+// DisabledTriggers returns the triggers that are disabled, including those
+// disabled for panicking
+func (bot *Bot) DisabledTriggers() []TriggerID {
+	bot.triggersMu.RLock()
+	defer bot.triggersMu.RUnlock()
+	var ids []TriggerID
+	for _, t := range bot.handlers {
+		if t.disabled {
+			ids = append(ids, t.id)
+		}
+	}
+	return ids
+}
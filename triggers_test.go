@@ -0,0 +1,62 @@
+package hbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplaceTriggerKeepsState(t *testing.T) {
+	bot, err := NewBot("irc.example.org", "hbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := Trigger{
+		Condition: func(*Bot, *Message) bool { return false },
+		Action:    func(*Bot, *Message) bool { return false },
+	}
+	id := bot.AddTrigger(noop, TriggerName("flaky"), TriggerPriority(5), TriggerTimeout(time.Second))
+	msg := ParseMessage(":alice!a@host PRIVMSG #chan :hi")
+
+	// Two of the three panics allowed before it is disabled
+	for i := 0; i < 2; i++ {
+		bot.triggersMu.RLock()
+		_, tr := bot.findTrigger(id)
+		bot.triggersMu.RUnlock()
+		bot.triggerPanicked(tr, msg, "boom", nil)
+	}
+	if !bot.ReplaceTrigger(id, noop) {
+		t.Fatal("ReplaceTrigger failed")
+	}
+	bot.triggersMu.RLock()
+	_, tr := bot.findTrigger(id)
+	bot.triggersMu.RUnlock()
+	if tr.name != "flaky" || tr.priority != 5 || tr.timeout != time.Second {
+		t.Errorf("replaced trigger lost its options: %+v", tr)
+	}
+	if len(tr.panics) != 2 {
+		t.Fatalf("replaced trigger has %d panics, want 2", len(tr.panics))
+	}
+	bot.triggerPanicked(tr, msg, "boom", nil)
+	if ids := bot.DisabledTriggers(); len(ids) != 1 || ids[0] != id {
+		t.Errorf("disabled triggers = %v, want %v", ids, id)
+	}
+
+	// The built-in trigger stays outside of the middleware
+	var builtin TriggerID
+	bot.triggersMu.RLock()
+	for _, tr := range bot.handlers {
+		if tr.builtin {
+			builtin = tr.id
+		}
+	}
+	bot.triggersMu.RUnlock()
+	if !bot.ReplaceTrigger(builtin, noop) {
+		t.Fatal("ReplaceTrigger failed")
+	}
+	bot.triggersMu.RLock()
+	_, tr = bot.findTrigger(builtin)
+	bot.triggersMu.RUnlock()
+	if !tr.builtin {
+		t.Error("replaced trigger is no longer built in")
+	}
+}
@@ -0,0 +1,214 @@
+package hbot
+
+import (
+	"strings"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Token we tag our WHOX queries with, to recognize the replies
+const whoxToken = "152"
+
+// Capabilities that keep the user registry up to date without polling
+var stateCaps = []string{"multi-prefix", "userhost-in-names", "extended-join",
+	"account-notify", "away-notify", "chghost", "setname"}
+
+// User is what the bot knows about a user it shares a channel with. Fields
+// are empty until the server told us about them.
+type User struct {
+	Nick     string
+	Ident    string
+	Host     string
+	Realname string
+	// Account the user is logged in to, empty if none
+	Account string
+	Away    bool
+	// Away message, if the server sent it
+	AwayMessage string
+}
+
+// handleUser updates the user registry from m, once the channels were
+// updated. It is called with s.mu held, and returns the commands to send
+// once it is released.
+func (s *State) handleUser(is *ISupport, nick string, m *Message) []string {
+	// Any message tells us where its sender connects from
+	if m.Prefix != nil && m.Prefix.User != "" {
+		if u := s.users[is.Fold(nick)]; u != nil {
+			u.Ident, u.Host = m.Prefix.User, m.Prefix.Host
+		}
+	}
+
+	switch m.Command {
+	case "JOIN":
+		if s.channels[is.Fold(m.Param(0))] == nil {
+			return nil
+		}
+		u := s.user(is, nick)
+		if m.Prefix != nil && m.Prefix.User != "" {
+			u.Ident, u.Host = m.Prefix.User, m.Prefix.Host
+		}
+		// extended-join: JOIN <channel> <account> :<realname>
+		if len(m.Params) > 2 {
+			u.Account = accountName(m.Param(1))
+			u.Realname = m.Param(2)
+		}
+
+	case irc.RPL_NAMREPLY:
+		if s.channels[is.Fold(m.Param(2))] == nil {
+			return nil
+		}
+		_, prefixes := is.Prefix()
+		for _, entry := range strings.Fields(m.Trailing()) {
+			p := irc.ParsePrefix(strings.TrimLeft(entry, prefixes))
+			if p.Name == "" {
+				continue
+			}
+			u := s.user(is, p.Name)
+			if p.User != "" {
+				u.Ident, u.Host = p.User, p.Host
+			}
+		}
+
+	case irc.RPL_ENDOFNAMES:
+		s.evict()
+		// Learn about everyone in a channel we just joined
+		ch := s.channels[is.Fold(m.Param(1))]
+		if ch == nil || ch.whoSent {
+			return nil
+		}
+		ch.whoSent = true
+		if is.WHOX() {
+			return []string{"WHO " + m.Param(1) + " %tnuhraf," + whoxToken}
+		}
+		return []string{"WHO " + m.Param(1)}
+
+	case irc.RPL_WHOREPLY:
+		// <client> <channel> <user> <host> <server> <nick> <flags> :<hopcount> <realname>
+		if u := s.users[is.Fold(m.Param(5))]; u != nil {
+			u.Ident, u.Host = m.Param(2), m.Param(3)
+			u.Away = strings.HasPrefix(m.Param(6), "G")
+			if fields := strings.SplitN(m.Trailing(), " ", 2); len(fields) == 2 {
+				u.Realname = fields[1]
+			}
+		}
+
+	// 354 RPL_WHOSPCRPL, fields in the order of "%tnuhraf":
+	// <client> <token> <user> <host> <nick> <flags> <account> :<realname>
+	case "354":
+		if m.Param(1) != whoxToken || len(m.Params) < 8 {
+			return nil
+		}
+		if u := s.users[is.Fold(m.Param(4))]; u != nil {
+			u.Ident, u.Host = m.Param(2), m.Param(3)
+			u.Away = strings.HasPrefix(m.Param(5), "G")
+			u.Realname = m.Param(7)
+			if m.Param(6) == "0" {
+				u.Account = ""
+			} else {
+				u.Account = m.Param(6)
+			}
+		}
+
+	case "ACCOUNT":
+		if u := s.users[is.Fold(nick)]; u != nil {
+			u.Account = accountName(m.Param(0))
+		}
+
+	case "AWAY":
+		if u := s.users[is.Fold(nick)]; u != nil {
+			u.Away = len(m.Params) > 0
+			u.AwayMessage = m.Trailing()
+		}
+
+	// 301 RPL_AWAY
+	case "301":
+		if u := s.users[is.Fold(m.Param(1))]; u != nil {
+			u.Away = true
+			u.AwayMessage = m.Trailing()
+		}
+
+	case "CHGHOST":
+		if u := s.users[is.Fold(nick)]; u != nil {
+			u.Ident, u.Host = m.Param(0), m.Param(1)
+		}
+
+	case "SETNAME":
+		if u := s.users[is.Fold(nick)]; u != nil {
+			u.Realname = m.Trailing()
+		}
+
+	case "NICK":
+		if u := s.users[is.Fold(nick)]; u != nil {
+			delete(s.users, is.Fold(u.Nick))
+			u.Nick = m.Param(0)
+			s.users[is.Fold(u.Nick)] = u
+		}
+
+	case "QUIT":
+		delete(s.users, is.Fold(nick))
+
+	case "PART", "KICK":
+		s.evict()
+	}
+	return nil
+}
+
+// user returns the registry entry for nick, creating it if needed
+func (s *State) user(is *ISupport, nick string) *User {
+	key := is.Fold(nick)
+	u := s.users[key]
+	if u == nil {
+		u = &User{Nick: nick}
+		s.users[key] = u
+	}
+	return u
+}
+
+// evict forgets the users that share no channel with the bot anymore
+func (s *State) evict() {
+	for key := range s.users {
+		if !s.inAnyChannel(key) {
+			delete(s.users, key)
+		}
+	}
+}
+
+func (s *State) inAnyChannel(key string) bool {
+	for _, ch := range s.channels {
+		if _, ok := ch.members[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// accountName turns the "*" used for no account into ""
+func accountName(account string) string {
+	if account == "*" {
+		return ""
+	}
+	return account
+}
+
+// User returns what the bot knows about nick. The boolean is false if nick
+// shares no channel with the bot.
+func (s *State) User(nick string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[s.bot.ISupport().Fold(nick)]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// Users returns all users that share a channel with the bot
+func (s *State) Users() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, *u)
+	}
+	return users
+}